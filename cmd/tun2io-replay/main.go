@@ -0,0 +1,99 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+// tun2io-replay injects the client packets of a pcap file into a go-tun2io
+// stack without device, and writes the packets it answers with to another
+// pcap file.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+	"golang.org/x/net/proxy"
+	"github.com/FTwOoO/go-tun2io/tun2io"
+)
+
+func main() {
+	in := flag.String("pcap", "", "pcap or pcapng file to replay")
+	out := flag.String("out", "", "pcapng file receiving the packets written by the stack")
+	addr := flag.String("addr", "192.168.4.1/24", "address and subnet of the stack")
+	client := flag.String("client", "", "subnet of the packets to inject, default to the inbound packets")
+	speed := flag.Float64("speed", 1, "timing factor, 0 to replay as fast as possible")
+	linger := flag.Duration("linger", 2 * time.Second, "time to collect packets after the last one")
+	socks := flag.String("socks", "", "SOCKS5 server of the tunnels, default to direct")
+	dns := flag.Bool("dns", true, "create the local DNS server")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ip, subnet, err := net.ParseCIDR(*addr)
+	if err != nil {
+		log.Fatalf("Bad address: %v", *addr)
+	}
+
+	config := tun2io.ReplayConfig{Speed:*speed, Linger:*linger}
+	if *client != "" {
+		if _, config.ClientNet, err = net.ParseCIDR(*client); err != nil {
+			log.Fatalf("Bad client subnet: %v", *client)
+		}
+	}
+
+	var dialer proxy.Dialer = &tun2io.DirectDialer{}
+	if *socks != "" {
+		dialer = &tun2io.SOCKS5Dialer{SocksAddr:*socks}
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := tun2io.NewPcapReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, ep, err := tun2io.NewMemoryTun2IO(ip, subnet, *dns, dialer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Manager = m
+
+	result, err := tun2io.Replay(ep, r, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("injected:%d skipped:%d emitted:%d dropped:%d\n", result.Injected, result.Skipped, len(result.Emitted), ep.Dropped())
+
+	if *out != "" {
+		c, err := tun2io.NewCapture(tun2io.CaptureConfig{Path:*out, Format:tun2io.CapturePcapng})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range result.Emitted {
+			c.WritePacketAt(p.Time, true, p.Data)
+		}
+		c.Close()
+	}
+}
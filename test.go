@@ -20,15 +20,15 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/FTwOoO/netstack/tcpip/link/rawfile"
 	"github.com/FTwOoO/netstack/tcpip/link/tun"
-	"github.com/FTwOoO/netstack/tcpip/stack"
-	"github.com/FTwOoO/netstack/tcpip/buffer"
 	"github.com/FTwOoO/netstack/tcpip/header"
-	"github.com/FTwOoO/netstack/tcpip"
 	"github.com/FTwOoO/go-tun2io/tun2io"
 )
 
@@ -38,6 +38,14 @@ var defaultDNSPort uint16 = 53
 var addrName = "192.168.4.1/24"
 var tunName = "tun2"
 
+// configureTun creates and configures tunName through netlink instead of
+// using the one set up by hand, tunRoutes are then routed through it
+var configureTun = false
+var tunRoutes = []string{"74.208.215.34/32"}
+var routeStatePath = "/tmp/tun2io-routes.json"
+var tunQueues = 1
+var tunTAP = false
+
 const dnsReqFre = 15 * time.Second
 
 
@@ -49,49 +57,77 @@ func main() {
 		log.Fatalf("Bad IP address: %v", addrName)
 	}
 
-	mtu, err := rawfile.GetMTU(tunName)
-	if err != nil {
-		log.Fatal(err)
-	}
+	dialer := &tun2io.SOCKS5Dialer{SocksAddr:socksAddr}
 
-	fd, err := tun.Open(tunName)
-	if err != nil {
-		log.Fatal(err)
+	var manager *tun2io.Tun2ioManager
+	if configureTun {
+		manager = openConfiguredTun(parsedIp, subnet, dialer)
+	} else {
+		mtu, err := rawfile.GetMTU(tunName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fd, err := tun.Open(tunName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		linkId, err := tun2io.CreateFdLinkEndpoint(fd, mtu)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		manager, err = tun2io.Tun2IO(parsedIp, subnet, linkId, true, dialer)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	linkId, err := tun2io.CreateFdLinkEndpoint(fd, mtu)
+	go remoteDNSTest(parsedIp, manager)
+	go localDNSServerTest(parsedIp, manager)
+	manager.MainLoop()
+
+}
+
+// openConfiguredTun starts the manager on tunName configured through netlink
+// and routes tunRoutes through it, except the SOCKS5 server. The configuration
+// is removed on SIGINT or SIGTERM, or by the next run after a crash.
+func openConfiguredTun(ip net.IP, subnet *net.IPNet, dialer *tun2io.SOCKS5Dialer) *tun2io.Tun2ioManager {
+	config := tun2io.TunConfig{Name:tunName, Queues:tunQueues, TAP:tunTAP, Addrs:[]*net.IPNet{{IP:ip, Mask:subnet.Mask}}}
+	manager, dev, err := tun2io.Tun2IOWithTun(config, true, dialer)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	dialer := &tun2io.SOCKS5Dialer{SocksAddr:socksAddr}
-	if err != nil {
-		log.Fatal(err)
+	routeConfig := tun2io.TunRouteConfig{Router:manager.GetRouter(), StatePath:routeStatePath}
+	for _, r := range tunRoutes {
+		_, route, err := net.ParseCIDR(r)
+		if err != nil {
+			log.Fatalf("Bad route: %v", r)
+		}
+		routeConfig.Include = append(routeConfig.Include, route)
 	}
 
-	manager, err := tun2io.Tun2IO(parsedIp, subnet, linkId, true, dialer)
-	if err != nil {
+	routes := tun2io.NewTunRoutes(dev, routeConfig)
+	if err := routes.Install(); err != nil {
+		dev.Close()
 		log.Fatal(err)
 	}
 
-	go remoteDNSTest(parsedIp, manager.GetStack(), linkId, manager.GetNICID())
-	go localDNSServerTest(parsedIp, manager.GetStack(), linkId, manager.GetNICID())
-	manager.MainLoop()
-
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		routes.Close()
+		dev.Close()
+		os.Exit(0)
+	}()
+	return manager
 }
 
-func injectIpv4Packet(s tcpip.Stack, linkId tcpip.LinkEndpointID, nid tcpip.NICID, packetData []byte) {
-	ep := stack.FindLinkEndpoint(linkId)
-	if ep == nil {
-		log.Fatalf("Endpoint not found:%d", linkId)
-		return
-	}
-
-	d := s.(*stack.Stack).GetNic(nid)
-
-	view := buffer.View(packetData)
-	vv := buffer.NewVectorisedView(len(packetData), []buffer.View{view})
-	d.DeliverNetworkPacket(ep, header.IPv4ProtocolNumber, &vv)
+func injectIpv4Packet(manager *tun2io.Tun2ioManager, packetData []byte) {
+	manager.InjectPacket(header.IPv4ProtocolNumber, packetData)
 }
 
 func createDNSRequst(Domain string, SrcIP net.IP, SrcPort uint16, DstIP net.IP, DstPort uint16) []byte {
@@ -118,11 +154,11 @@ func createDNSRequst(Domain string, SrcIP net.IP, SrcPort uint16, DstIP net.IP,
 	return packetData
 }
 
-func remoteDNSTest(srcAddr net.IP, s tcpip.Stack, linkId tcpip.LinkEndpointID, nid tcpip.NICID) error {
+func remoteDNSTest(srcAddr net.IP, manager *tun2io.Tun2ioManager) error {
 	for {
 
 		packetData := createDNSRequst("facebook.com", srcAddr, 10078, defaultRemoteDnsServer, defaultDNSPort)
-		injectIpv4Packet(s, linkId, nid, packetData)
+		injectIpv4Packet(manager, packetData)
 
 		time.Sleep(dnsReqFre)
 	}
@@ -130,11 +166,11 @@ func remoteDNSTest(srcAddr net.IP, s tcpip.Stack, linkId tcpip.LinkEndpointID, n
 	return nil
 }
 
-func localDNSServerTest(srcAddr net.IP, s tcpip.Stack, linkId tcpip.LinkEndpointID, nid tcpip.NICID) error {
+func localDNSServerTest(srcAddr net.IP, manager *tun2io.Tun2ioManager) error {
 	for {
 
 		packetData := createDNSRequst("twitter.com", srcAddr, 10079, srcAddr, defaultDNSPort)
-		injectIpv4Packet(s, linkId, nid, packetData)
+		injectIpv4Packet(manager, packetData)
 
 		time.Sleep(dnsReqFre)
 	}
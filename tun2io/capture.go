@@ -0,0 +1,407 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+type CaptureFormat int
+
+const (
+	CapturePcap   CaptureFormat = iota
+	CapturePcapng
+)
+
+const (
+	// packets are written without link header
+	linkTypeRaw = 101
+
+	defaultSnapLen = 65535
+)
+
+var (
+	errNoCaptureOutput = errors.New("Capture needs a path or a writer.")
+	errNoCaptureEndpoint = errors.New("Link endpoint does not support capture.")
+)
+
+// CaptureConfig describes where and what to capture.
+type CaptureConfig struct {
+	// Path is the file written, Writer is used if Path is empty
+	Path     string
+	Writer   io.Writer
+
+	Format   CaptureFormat
+
+	// Filter is a tcpdump like expression, see compileCaptureFilter
+	Filter   string
+
+	// SnapLen is the maximum number of bytes kept of each packet
+	SnapLen  int
+
+	// MaxSize is the maximum size of a file in bytes, 0 for no limit. When
+	// a file is full it is renamed to Path.1, the older ones are shifted up to
+	// Path.<MaxFiles-1> and a new file is started. Captures to a Writer stop
+	// when it is full.
+	MaxSize  int64
+	MaxFiles int
+}
+
+type CaptureStats struct {
+	Packets  uint64
+	Bytes    uint64
+	Filtered uint64
+	Files    int
+}
+
+func (s CaptureStats) ToString() string {
+	return fmt.Sprintf("packets:%d bytes:%d filtered:%d files:%d", s.Packets, s.Bytes, s.Filtered, s.Files)
+}
+
+// Capture writes IP packets in pcap or pcapng format.
+type Capture struct {
+	mu      sync.Mutex
+	config  CaptureConfig
+	filter  captureFilter
+	file    *os.File
+	w       io.Writer
+	size    int64
+	full    bool
+	stats   CaptureStats
+}
+
+func NewCapture(config CaptureConfig) (*Capture, error) {
+	if config.Path == "" && config.Writer == nil {
+		return nil, errNoCaptureOutput
+	}
+	if config.SnapLen <= 0 {
+		config.SnapLen = defaultSnapLen
+	}
+
+	filter, err := compileCaptureFilter(config.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Capture{config:config, filter:filter, w:config.Writer}
+	if config.Path != "" {
+		if err := c.openFile(); err != nil {
+			return nil, err
+		}
+	} else if err := c.writeFileHeader(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capture) openFile() error {
+	f, err := os.Create(c.config.Path)
+	if err != nil {
+		return err
+	}
+
+	c.file = f
+	c.w = f
+	c.size = 0
+	c.stats.Files++
+	return c.writeFileHeader()
+}
+
+// rotate shifts Path.N to Path.N+1, keeping MaxFiles files including the
+// current one, and starts a new file.
+func (c *Capture) rotate() error {
+	c.file.Close()
+	rotateFiles(c.config.Path, c.config.MaxFiles)
+	return c.openFile()
+}
+
+func (c *Capture) writeFileHeader() error {
+	var hdr []byte
+	if c.config.Format == CapturePcapng {
+		// section header block
+		shb := make([]byte, 28)
+		binary.LittleEndian.PutUint32(shb[0:], 0x0a0d0d0a)
+		binary.LittleEndian.PutUint32(shb[4:], 28)
+		binary.LittleEndian.PutUint32(shb[8:], 0x1a2b3c4d)
+		binary.LittleEndian.PutUint16(shb[12:], 1)
+		binary.LittleEndian.PutUint16(shb[14:], 0)
+		binary.LittleEndian.PutUint64(shb[16:], 0xffffffffffffffff)
+		binary.LittleEndian.PutUint32(shb[24:], 28)
+
+		// interface description block
+		idb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(idb[0:], 1)
+		binary.LittleEndian.PutUint32(idb[4:], 20)
+		binary.LittleEndian.PutUint16(idb[8:], linkTypeRaw)
+		binary.LittleEndian.PutUint32(idb[12:], uint32(c.config.SnapLen))
+		binary.LittleEndian.PutUint32(idb[16:], 20)
+
+		hdr = append(shb, idb...)
+	} else {
+		hdr = make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], uint32(c.config.SnapLen))
+		binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	}
+
+	n, err := c.w.Write(hdr)
+	c.size += int64(n)
+	return err
+}
+
+func (c *Capture) buildRecord(ts time.Time, outbound bool, pkt []byte) []byte {
+	data := pkt
+	if len(data) > c.config.SnapLen {
+		data = data[:c.config.SnapLen]
+	}
+	usec := uint64(ts.UnixNano() / 1000)
+
+	if c.config.Format != CapturePcapng {
+		rec := make([]byte, 16 + len(data))
+		binary.LittleEndian.PutUint32(rec[0:], uint32(usec / 1000000))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(usec % 1000000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+		copy(rec[16:], data)
+		return rec
+	}
+
+	// enhanced packet block with the epb_flags option giving the direction
+	padded := (len(data) + 3) &^ 3
+	total := 28 + padded + 12 + 4
+	rec := make([]byte, total)
+	binary.LittleEndian.PutUint32(rec[0:], 6)
+	binary.LittleEndian.PutUint32(rec[4:], uint32(total))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(usec >> 32))
+	binary.LittleEndian.PutUint32(rec[16:], uint32(usec))
+	binary.LittleEndian.PutUint32(rec[20:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[24:], uint32(len(pkt)))
+	copy(rec[28:], data)
+
+	opt := rec[28 + padded:]
+	binary.LittleEndian.PutUint16(opt[0:], 2)
+	binary.LittleEndian.PutUint16(opt[2:], 4)
+	if outbound {
+		binary.LittleEndian.PutUint32(opt[4:], 2)
+	} else {
+		binary.LittleEndian.PutUint32(opt[4:], 1)
+	}
+	binary.LittleEndian.PutUint32(rec[total - 4:], uint32(total))
+	return rec
+}
+
+// WritePacket captures an IP packet, outbound is true for the packets sent to
+// the link.
+func (c *Capture) WritePacket(outbound bool, pkt []byte) {
+	c.WritePacketAt(time.Now(), outbound, pkt)
+}
+
+// WritePacketAt captures an IP packet seen at ts.
+func (c *Capture) WritePacketAt(ts time.Time, outbound bool, pkt []byte) {
+	p, ok := parseCapturePacket(pkt)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.w == nil || c.full {
+		return
+	}
+	if !ok || !c.filter(&p) {
+		c.stats.Filtered++
+		return
+	}
+
+	rec := c.buildRecord(ts, outbound, pkt)
+	if c.config.MaxSize > 0 && c.size + int64(len(rec)) > c.config.MaxSize {
+		if c.file == nil {
+			c.full = true
+			return
+		}
+		if err := c.rotate(); err != nil {
+			log.Printf("Rotate capture failed: %s\n", err)
+			c.w = nil
+			return
+		}
+	}
+
+	n, err := c.w.Write(rec)
+	c.size += int64(n)
+	if err != nil {
+		log.Printf("Write capture failed: %s\n", err)
+		c.w = nil
+		return
+	}
+	c.stats.Packets++
+	c.stats.Bytes += uint64(len(pkt))
+}
+
+func (c *Capture) Stats() CaptureStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close stops the capture, the file is closed but not a Writer.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.w = nil
+	if c.file != nil {
+		f := c.file
+		c.file = nil
+		return f.Close()
+	}
+	return nil
+}
+
+// CaptureEndpoint is a link endpoint passing packets between the stack and a
+// lower link endpoint, writing a copy of them to its capture if one is set.
+type CaptureEndpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+
+	mu         sync.RWMutex
+	capture    *Capture
+
+	// inbound sees the inbound packets before the stack, the ones it
+	// returns true for are not delivered
+	inbound    func(tcpip.NetworkProtocolNumber, *buffer.VectorisedView) bool
+
+	// mss clamps the MSS option of the SYN segments, if not 0
+	mss        uint16
+}
+
+// NewCaptureEndpoint wraps the link endpoint lower, the returned endpoint is
+// used in its place.
+func NewCaptureEndpoint(lower tcpip.LinkEndpointID) (tcpip.LinkEndpointID, *CaptureEndpoint) {
+	e := &CaptureEndpoint{lower:stack.FindLinkEndpoint(lower)}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetCapture starts writing packets to c, or stops if c is nil. The previous
+// capture is returned.
+func (e *CaptureEndpoint) SetCapture(c *Capture) *Capture {
+	e.mu.Lock()
+	old := e.capture
+	e.capture = c
+	e.mu.Unlock()
+	return old
+}
+
+func (e *CaptureEndpoint) Capture() *Capture {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.capture
+}
+
+// setInbound makes h handle the inbound packets before the stack.
+func (e *CaptureEndpoint) setInbound(h func(tcpip.NetworkProtocolNumber, *buffer.VectorisedView) bool) {
+	e.mu.Lock()
+	e.inbound = h
+	e.mu.Unlock()
+}
+
+// setMSSClamp makes the endpoint lower the MSS option of the SYN segments to
+// mss in both directions, 0 stops it.
+func (e *CaptureEndpoint) setMSSClamp(mss uint16) {
+	e.mu.Lock()
+	e.mss = mss
+	e.mu.Unlock()
+}
+
+// DeliverNetworkPacket implements the stack.NetworkDispatcher interface, it is
+// called by the lower endpoint for inbound packets. Packets injected with it
+// directly are captured too.
+func (e *CaptureEndpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.mu.RLock()
+	c, inbound, mss := e.capture, e.inbound, e.mss
+	e.mu.RUnlock()
+
+	// The packet is flattened once for the clamp and the capture, and not at
+	// all without them
+	if mss != 0 || c != nil {
+		pkt := vv.ToView()
+		if mss != 0 {
+			clampMSS(pkt, mss)
+		}
+		if c != nil {
+			c.WritePacket(false, pkt)
+		}
+		flat := buffer.NewVectorisedView(len(pkt), []buffer.View{pkt})
+		vv = &flat
+	}
+	if inbound != nil && inbound(protocol, vv) {
+		return
+	}
+	e.dispatcher.DeliverNetworkPacket(e, protocol, vv)
+}
+
+// Attach implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements the stack.LinkEndpoint interface.
+func (e *CaptureEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+	e.mu.RLock()
+	mss := e.mss
+	e.mu.RUnlock()
+
+	// The stack writes the TCP header with its options in hdr
+	if mss != 0 {
+		clampMSS(hdr.UsedBytes(), mss)
+	}
+	if c := e.Capture(); c != nil {
+		c.WritePacket(true, joinPacket(hdr, payload))
+	}
+	return e.lower.WritePacket(r, hdr, payload, protocol)
+}
@@ -0,0 +1,275 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// capturePacket is what the capture filter looks at in an IP packet.
+type capturePacket struct {
+	version  int
+	proto    uint8
+	src      net.IP
+	dst      net.IP
+	hasPorts bool
+	srcPort  uint16
+	dstPort  uint16
+}
+
+func parseCapturePacket(pkt []byte) (p capturePacket, ok bool) {
+	if len(pkt) < 1 {
+		return p, false
+	}
+
+	var off int
+	fragmented := false
+	p.version = int(pkt[0] >> 4)
+	switch p.version {
+	case 4:
+		if len(pkt) < ipv4HeaderSize {
+			return p, false
+		}
+		off = int(pkt[0] & 0x0f) * 4
+		p.proto = pkt[9]
+		p.src = net.IP(pkt[12:16])
+		p.dst = net.IP(pkt[16:20])
+		fragmented = binary.BigEndian.Uint16(pkt[6:]) & 0x1fff != 0
+	case 6:
+		if len(pkt) < ipv6HeaderSize {
+			return p, false
+		}
+		off = ipv6HeaderSize
+		p.proto = pkt[6]
+		p.src = net.IP(pkt[8:24])
+		p.dst = net.IP(pkt[24:40])
+
+		// skip the extension headers
+		Extensions:for {
+			switch p.proto {
+			case 0, 43, 60:
+				if len(pkt) < off + 2 {
+					return p, true
+				}
+				p.proto = pkt[off]
+				off += (int(pkt[off + 1]) + 1) * 8
+			case 44:
+				if len(pkt) < off + 8 {
+					return p, true
+				}
+				p.proto = pkt[off]
+				fragmented = binary.BigEndian.Uint16(pkt[off + 2:]) & 0xfff8 != 0
+				off += 8
+			default:
+				break Extensions
+			}
+		}
+	default:
+		return p, false
+	}
+
+	if (p.proto == ipProtoTCP || p.proto == ipProtoUDP) && !fragmented && len(pkt) >= off + 4 {
+		p.hasPorts = true
+		p.srcPort = binary.BigEndian.Uint16(pkt[off:])
+		p.dstPort = binary.BigEndian.Uint16(pkt[off + 2:])
+	}
+	return p, true
+}
+
+// captureFilter tells whether a packet is captured.
+type captureFilter func(p *capturePacket) bool
+
+// compileCaptureFilter compiles a subset of the tcpdump filter syntax:
+//
+//	ip, ip6, tcp, udp, icmp, icmp6
+//	[src|dst] host ADDR
+//	[src|dst] net CIDR
+//	[src|dst] port PORT
+//
+// combined with not, and, or (or !, &&, ||) and parentheses. An empty
+// expression matches every packet.
+func compileCaptureFilter(expr string) (captureFilter, error) {
+	for _, sep := range []string{"(", ")", "!"} {
+		expr = strings.Replace(expr, sep, " " + sep + " ", -1)
+	}
+	p := &filterParser{tokens:strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return func(*capturePacket) bool { return true }, nil
+	}
+
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected '%s' in capture filter.", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("Unexpected end of capture filter.")
+	}
+	p.pos++
+	return p.tokens[p.pos - 1], nil
+}
+
+func (p *filterParser) parseOr() (captureFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for tok := p.peek(); tok == "or" || tok == "||"; tok = p.peek() {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *capturePacket) bool { return l(c) || right(c) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (captureFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for tok := p.peek(); tok == "and" || tok == "&&"; tok = p.peek() {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *capturePacket) bool { return l(c) && right(c) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (captureFilter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *capturePacket) bool { return !f(c) }, nil
+	case "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("Missing ')' in capture filter.")
+		}
+		return f, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (captureFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(tok) {
+	case "ip":
+		return func(c *capturePacket) bool { return c.version == 4 }, nil
+	case "ip6":
+		return func(c *capturePacket) bool { return c.version == 6 }, nil
+	case "tcp":
+		return func(c *capturePacket) bool { return c.proto == ipProtoTCP }, nil
+	case "udp":
+		return func(c *capturePacket) bool { return c.proto == ipProtoUDP }, nil
+	case "icmp":
+		return func(c *capturePacket) bool { return c.proto == ipProtoICMP }, nil
+	case "icmp6":
+		return func(c *capturePacket) bool { return c.proto == ipProtoICMPv6 }, nil
+	}
+
+	src, dst := true, true
+	switch strings.ToLower(tok) {
+	case "src":
+		dst = false
+		tok, err = p.next()
+	case "dst":
+		src = false
+		tok, err = p.next()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	arg, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(tok) {
+	case "host":
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("Bad host '%s' in capture filter.", arg)
+		}
+		return func(c *capturePacket) bool {
+			return (src && ip.Equal(c.src)) || (dst && ip.Equal(c.dst))
+		}, nil
+	case "net":
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Bad net '%s' in capture filter.", arg)
+		}
+		return func(c *capturePacket) bool {
+			return (src && n.Contains(c.src)) || (dst && n.Contains(c.dst))
+		}, nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Bad port '%s' in capture filter.", arg)
+		}
+		return func(c *capturePacket) bool {
+			return c.hasPorts && ((src && c.srcPort == uint16(port)) || (dst && c.dstPort == uint16(port)))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown primitive '%s' in capture filter.", tok)
+}
@@ -0,0 +1,112 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCapturePcapngBlocks(t *testing.T) {
+	v4Client, v4Server := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")
+	v6Client, v6Server := net.ParseIP("fd00::2"), net.ParseIP("fd00::1")
+	ts := time.Unix(1500000000, 123456000)
+
+	tests := []struct {
+		name     string
+		snapLen  int
+		outbound bool
+		pkt      []byte
+	}{
+		{"inbound UDP, 1 byte of padding", 0, false, buildTestUDP(v4Client, v4Server, 1000, 53, []byte("abc"))},
+		{"outbound UDP, no padding", 0, true, buildTestUDP(v4Server, v4Client, 53, 1000, []byte("abcd"))},
+		{"outbound IPv6 TCP", 0, true, buildTestTCP(v6Server, v6Client, 80, 1000, 1, 2, 0x12, nil)},
+		{"truncated to the snap length", 30, false, buildTestUDP(v4Client, v4Server, 1000, 53, make([]byte, 100))},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		c, err := NewCapture(CaptureConfig{Writer:&buf, Format:CapturePcapng, SnapLen:tt.snapLen})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WritePacketAt(ts, tt.outbound, tt.pkt)
+		c.Close()
+
+		data := buf.Bytes()
+		if len(data) < 48 {
+			t.Errorf("%s: capture of %d bytes", tt.name, len(data))
+			continue
+		}
+		shb, idb, epb := data[:28], data[28:48], data[48:]
+		if binary.LittleEndian.Uint32(shb[0:]) != 0x0a0d0d0a || binary.LittleEndian.Uint32(shb[8:]) != 0x1a2b3c4d ||
+			binary.LittleEndian.Uint32(shb[24:]) != 28 {
+			t.Errorf("%s: bad section header block %x", tt.name, shb)
+		}
+		if binary.LittleEndian.Uint32(idb[0:]) != 1 || binary.LittleEndian.Uint16(idb[8:]) != linkTypeRaw ||
+			binary.LittleEndian.Uint32(idb[16:]) != 20 {
+			t.Errorf("%s: bad interface description block %x", tt.name, idb)
+		}
+
+		captured := tt.pkt
+		if tt.snapLen > 0 && len(captured) > tt.snapLen {
+			captured = captured[:tt.snapLen]
+		}
+		total := 28 + (len(captured) + 3) &^ 3 + 16
+		if len(epb) != total || binary.LittleEndian.Uint32(epb[0:]) != 6 ||
+			binary.LittleEndian.Uint32(epb[4:]) != uint32(total) || binary.LittleEndian.Uint32(epb[total - 4:]) != uint32(total) {
+			t.Errorf("%s: enhanced packet block of %d bytes, want %d", tt.name, len(epb), total)
+			continue
+		}
+		if binary.LittleEndian.Uint32(epb[20:]) != uint32(len(captured)) || binary.LittleEndian.Uint32(epb[24:]) != uint32(len(tt.pkt)) {
+			t.Errorf("%s: lengths %d/%d, want %d/%d", tt.name, binary.LittleEndian.Uint32(epb[20:]),
+				binary.LittleEndian.Uint32(epb[24:]), len(captured), len(tt.pkt))
+		}
+		for _, b := range epb[28 + len(captured):28 + (len(captured) + 3) &^ 3] {
+			if b != 0 {
+				t.Errorf("%s: padding %x is not zero", tt.name, epb[28 + len(captured):])
+				break
+			}
+		}
+
+		r, err := NewPcapReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := r.Next()
+		if err != nil {
+			t.Errorf("%s: read back failed: %s", tt.name, err)
+			continue
+		}
+		direction := DirectionInbound
+		if tt.outbound {
+			direction = DirectionOutbound
+		}
+		if !p.Time.Equal(ts) || p.Direction != direction || !bytes.Equal(p.Data, captured) {
+			t.Errorf("%s: read back %s direction %d %x, want %s direction %d %x", tt.name,
+				p.Time, p.Direction, p.Data, ts, direction, captured)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("%s: read after the packet: %v, want EOF", tt.name, err)
+		}
+	}
+}
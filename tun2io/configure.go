@@ -18,24 +18,161 @@ package tun2io
 
 import (
 	"errors"
+	"net"
+	"strconv"
 	"time"
 	"github.com/FTwOoO/netstack/tcpip"
 	"fmt"
 	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
 )
 
 var (
 	errBufferIsFull = errors.New("Buffer is full.")
 	errDeviceClosed = errors.New("Device is closed.")
 	ErrTimeout = errors.New("operation timed out")
-	readTimeout = time.Second * 60
-	writeTimeout = time.Second * 10
-	listenTimeout = time.Second * 120
+	errNoDnsHandler = errors.New("No DNS handler configured.")
+	errNoAddrs = errors.New("No address configured.")
+	errDNSAddrNotLocal = errors.New("DNS address is not an address of the NIC.")
+	errInvalidConfig = errors.New("Invalid config.")
+)
 
+const (
+	defaultReadTimeout = time.Second * 60
+	defaultWriteTimeout = time.Second * 10
+	defaultListenTimeout = time.Second * 120
+	defaultDNSQueryTimeout = time.Second * 5
+	defaultDNSWorkers = 16
+	defaultSniffTimeout = time.Millisecond * 300
+	defaultICMPFlowTimeout = time.Second * 30
 	defaultNicId tcpip.NICID = 1
-	defaultDNSPort uint16 = 53
+	defaultQueueSize = 256
+
+	// dnsPort is the port of the flows hijacked, and the default port of the
+	// DNS endpoints
+	dnsPort uint16 = 53
 )
 
+// Config is the configuration of a manager, the zero value of a field is
+// replaced by its default.
+type Config struct {
+	// Addrs are the addresses of the NIC, each with the mask of its subnet
+	Addrs           []*net.IPNet
+
+	// NICID is the id of the NIC, 1 by default
+	NICID           tcpip.NICID
+
+	// Dialer is the dialer of the default route, proxy.Direct by default
+	Dialer          proxy.Dialer
+
+	// ReadTimeout and WriteTimeout close the tunnels and the DNS endpoints
+	// blocked for longer on a read or a write, ListenTimeout closes the TCP
+	// listeners left without connection
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ListenTimeout   time.Duration
+
+	// DNS creates DNS endpoints on DNSPort of DNSAddrs, or of every address
+	// of Addrs. Their queries go through the cache, the hosts and the filter
+	// of the manager, then to DNSHandler, a dnsrelay server by default
+	DNS             bool
+	DNSAddrs        []net.IP
+	DNSPort         uint16
+	DNSHandler      dns.Handler
+
+	// DNSQueryTimeout is the time a DNS endpoint waits for the reply of
+	// DNSHandler before answering SERVFAIL, DNSWorkers the number of queries
+	// it serves at once
+	DNSQueryTimeout time.Duration
+	DNSWorkers      int
+
+	// SniffTimeout is the longest wait for the first bytes of a client on
+	// the sniffed ports
+	SniffTimeout    time.Duration
+
+	// ICMPFlowTimeout closes the sockets of the forwarded echo requests idle
+	// for longer
+	ICMPFlowTimeout time.Duration
+
+	// ReadBufferSize is the size of the reads from the connections of the
+	// tunnels, QueueSize the number of chunks queued in each direction
+	ReadBufferSize  int
+	QueueSize       int
+
+	// TCP tunes the TCP endpoints, it can be changed by SetTCPConfig
+	TCP             TCPConfig
+}
+
+// withDefaults returns c with the defaults of the fields not set.
+func (c Config) withDefaults() Config {
+	if c.NICID == 0 {
+		c.NICID = defaultNicId
+	}
+	if c.Dialer == nil {
+		c.Dialer = proxy.Direct
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.ListenTimeout == 0 {
+		c.ListenTimeout = defaultListenTimeout
+	}
+	if c.DNSPort == 0 {
+		c.DNSPort = dnsPort
+	}
+	if c.DNSQueryTimeout == 0 {
+		c.DNSQueryTimeout = defaultDNSQueryTimeout
+	}
+	if c.DNSWorkers == 0 {
+		c.DNSWorkers = defaultDNSWorkers
+	}
+	if c.SniffTimeout == 0 {
+		c.SniffTimeout = defaultSniffTimeout
+	}
+	if c.ICMPFlowTimeout == 0 {
+		c.ICMPFlowTimeout = defaultICMPFlowTimeout
+	}
+	if c.ReadBufferSize == 0 {
+		c.ReadBufferSize = readBufSize
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultQueueSize
+	}
+	return c
+}
+
+// validate checks c and returns it with its defaults.
+func (c Config) validate() (Config, error) {
+	if len(c.Addrs) == 0 {
+		return c, errNoAddrs
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.ListenTimeout < 0 || c.ReadBufferSize < 0 || c.QueueSize < 0 ||
+		c.DNSQueryTimeout < 0 || c.DNSWorkers < 0 || c.SniffTimeout < 0 || c.ICMPFlowTimeout < 0 {
+		return c, errInvalidConfig
+	}
+
+	for _, ip := range c.DNSAddrs {
+		local := false
+		for _, a := range c.Addrs {
+			local = local || a.IP.Equal(ip)
+		}
+		if !local {
+			return c, errDNSAddrNotLocal
+		}
+	}
+
+	tcpConfig, err := c.TCP.validate()
+	if err != nil {
+		return c, err
+	}
+	c.TCP = tcpConfig
+	return c.withDefaults(), nil
+}
+
 type TunnelStatus uint
 
 const (
@@ -67,14 +204,22 @@ type TransportID struct {
 	RemoteAddress tcpip.Address
 }
 
-func (id TransportID) ToString() string {
-
-	var protoName string
+// Network returns the network name of the transport, as used by proxy.Dialer.
+func (id TransportID) Network() string {
 	if id.Transport == header.TCPProtocolNumber {
-		protoName = "tcp"
+		return "tcp"
 	} else if id.Transport == header.UDPProtocolNumber {
-		protoName = "udp"
+		return "udp"
 	}
+	return ""
+}
+
+func (id TransportID) ToString() string {
+	return fmt.Sprintf("[%s]%s -> %s", id.Network(), hostPort(id.SrcAddress, id.SrcPort), hostPort(id.RemoteAddress, id.RemotePort))
+}
 
-	return fmt.Sprintf("[%s]%s:%d -> %s:%d", protoName, id.SrcAddress, id.SrcPort, id.RemoteAddress, id.RemotePort)
+// hostPort formats addr and port like net.JoinHostPort, with brackets around
+// IPv6 addresses.
+func hostPort(addr tcpip.Address, port uint16) string {
+	return net.JoinHostPort(net.IP(addr).String(), strconv.Itoa(int(port)))
 }
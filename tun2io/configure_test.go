@@ -0,0 +1,50 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	addrs := []*net.IPNet{{IP:net.ParseIP("192.168.4.1"), Mask:net.CIDRMask(24, 32)}}
+	c, err := Config{Addrs:addrs, SniffTimeout:time.Second}.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DNSQueryTimeout != defaultDNSQueryTimeout || c.DNSWorkers != defaultDNSWorkers ||
+		c.ICMPFlowTimeout != defaultICMPFlowTimeout {
+		t.Errorf("Defaults not set: %+v", c)
+	}
+	if c.SniffTimeout != time.Second {
+		t.Errorf("SniffTimeout %v, want 1s", c.SniffTimeout)
+	}
+
+	for _, bad := range []Config{
+		{Addrs:addrs, DNSQueryTimeout:-1},
+		{Addrs:addrs, DNSWorkers:-1},
+		{Addrs:addrs, SniffTimeout:-1},
+		{Addrs:addrs, ICMPFlowTimeout:-1},
+	} {
+		if _, err := bad.validate(); err != errInvalidConfig {
+			t.Errorf("Config %+v: error %v, want %v", bad, err, errInvalidConfig)
+		}
+	}
+}
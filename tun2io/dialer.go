@@ -23,23 +23,45 @@ import (
 	"errors"
 )
 
-type DirectDialer struct{}
+// UpstreamDialer is a dialer through servers, which must not be routed
+// through the tun.
+type UpstreamDialer interface {
+	UpstreamAddrs() []string
+}
+
+// DirectDialer connects directly, with the socket mark Mark if it is not 0.
+type DirectDialer struct {
+	Mark int
+}
 
 func (f *DirectDialer) Dial(network, addr string) (net.Conn, error) {
+	if f.Mark != 0 {
+		d := &net.Dialer{Control:markControl(f.Mark)}
+		return d.Dial(network, addr)
+	}
 	return net.Dial(network, addr)
 }
 
 type SOCKS5Dialer struct {
 	Auth      *proxy.Auth
 	SocksAddr string
+
+	// Mark is the socket mark of the connections to the server and of the
+	// direct UDP flows
+	Mark      int
+}
+
+// UpstreamAddrs implements the UpstreamDialer interface.
+func (f *SOCKS5Dialer) UpstreamAddrs() []string {
+	return []string{f.SocksAddr}
 }
 
 func (f *SOCKS5Dialer) Dial(network, addr string) (net.Conn, error) {
 	if network == "udp" {
-		return new(DirectDialer).Dial(network, addr)
+		return (&DirectDialer{Mark:f.Mark}).Dial(network, addr)
 	} else if network == "tcp" {
 
-		dialer, err := proxy.SOCKS5(network, f.SocksAddr, f.Auth, new(DirectDialer))
+		dialer, err := proxy.SOCKS5(network, f.SocksAddr, f.Auth, &DirectDialer{Mark:f.Mark})
 		if err != nil {
 			return nil, err
 		}
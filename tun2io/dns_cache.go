@@ -0,0 +1,328 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/miekg/dns"
+)
+
+const (
+	// TTL of answers served after expiry, as suggested by RFC 8767
+	dnsStaleAnswerTTL = 30
+
+	// an entry is prefetched when less than this percent of its TTL is left
+	dnsPrefetchPercent = 10
+)
+
+type DnsCacheStats struct {
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	StaleHits  uint64
+	Prefetches uint64
+}
+
+func (s DnsCacheStats) ToString() string {
+	return fmt.Sprintf("entries:%d hits:%d misses:%d stale:%d prefetches:%d",
+		s.Entries, s.Hits, s.Misses, s.StaleHits, s.Prefetches)
+}
+
+type dnsCacheEntry struct {
+	key        string
+	msg        *dns.Msg
+	stored     time.Time
+	expire     time.Time
+	hits       uint64
+	refreshing bool
+	elem       *list.Element
+}
+
+// DnsCache is a dns.Handler that answers repeated questions from memory and
+// forwards the rest to Next.
+type DnsCache struct {
+	hits         uint64
+	misses       uint64
+	staleHits    uint64
+	prefetches   uint64
+
+	Next         dns.Handler
+
+	// TTLs of positive answers are clamped into [MinTTL, MaxTTL]
+	MinTTL       time.Duration
+	MaxTTL       time.Duration
+
+	// NegativeTTL caps how long NXDOMAIN/NODATA answers are kept
+	NegativeTTL  time.Duration
+
+	// StaleTTL is how long an expired entry may still be served while it is
+	// refreshed in background, 0 disables serve-stale
+	StaleTTL     time.Duration
+
+	// PrefetchHits is the number of hits after which an entry close to
+	// expiry is refreshed before it expires, 0 disables prefetch
+	PrefetchHits uint64
+
+	MaxEntries   int
+
+	mu           sync.Mutex
+	entries      map[string]*dnsCacheEntry
+	lru          *list.List
+}
+
+func NewDnsCache(next dns.Handler) *DnsCache {
+	return &DnsCache{
+		Next:next,
+		MinTTL:5 * time.Second,
+		MaxTTL:time.Hour,
+		NegativeTTL:5 * time.Minute,
+		StaleTTL:24 * time.Hour,
+		PrefetchHits:3,
+		MaxEntries:4096,
+		entries:make(map[string]*dnsCacheEntry, 0),
+		lru:list.New(),
+	}
+}
+
+func dnsCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (c *DnsCache) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		c.Next.ServeDNS(w, req)
+		return
+	}
+
+	key := dnsCacheKey(req.Question[0])
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.After(entry.expire.Add(c.StaleTTL)) {
+		c.removeLocked(entry)
+		ok = false
+	}
+
+	if ok {
+		entry.hits++
+		c.lru.MoveToFront(entry.elem)
+
+		stale := now.After(entry.expire)
+		refresh := stale
+		if !stale && c.PrefetchHits > 0 && entry.hits >= c.PrefetchHits {
+			left := entry.expire.Sub(now)
+			refresh = left*100 < entry.expire.Sub(entry.stored)*dnsPrefetchPercent
+		}
+
+		if refresh && !entry.refreshing {
+			entry.refreshing = true
+			if !stale {
+				atomic.AddUint64(&c.prefetches, 1)
+			}
+			go c.refresh(req.Question[0])
+		}
+
+		resp := c.answer(entry, req, now, stale)
+		c.mu.Unlock()
+
+		if stale {
+			atomic.AddUint64(&c.staleHits, 1)
+		} else {
+			atomic.AddUint64(&c.hits, 1)
+		}
+
+		w.WriteMsg(resp)
+		return
+	}
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+
+	mw := newMsgWriter(w)
+	c.Next.ServeDNS(mw, req)
+	if mw.msg == nil {
+		return
+	}
+
+	c.store(key, mw.msg)
+	w.WriteMsg(mw.msg)
+}
+
+// answer builds a reply to req from a cached entry, with TTLs counted down by
+// the time the entry spent in the cache.
+func (c *DnsCache) answer(entry *dnsCacheEntry, req *dns.Msg, now time.Time, stale bool) *dns.Msg {
+	resp := entry.msg.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if stale {
+				hdr.Ttl = dnsStaleAnswerTTL
+			} else if hdr.Ttl > age {
+				hdr.Ttl -= age
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+
+	return resp
+}
+
+func (c *DnsCache) refresh(q dns.Question) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.Question[0].Qclass = q.Qclass
+
+	key := dnsCacheKey(q)
+	mw := newMsgWriter(nil)
+	c.Next.ServeDNS(mw, req)
+
+	if mw.msg == nil || !c.store(key, mw.msg) {
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// store caches msg under key, it returns false if the answer is not cacheable.
+func (c *DnsCache) store(key string, msg *dns.Msg) bool {
+	ttl, ok := c.ttlOf(msg)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{key:key, msg:msg.Copy(), stored:now, expire:now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		entry.hits = old.hits
+		c.removeLocked(old)
+	}
+
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[key] = entry
+
+	for c.MaxEntries > 0 && len(c.entries) > c.MaxEntries {
+		c.removeLocked(c.lru.Back().Value.(*dnsCacheEntry))
+	}
+
+	return true
+}
+
+// ttlOf returns how long msg can be cached, negative answers are handled as
+// described in RFC 2308 and are not cached without a SOA record.
+func (c *DnsCache) ttlOf(msg *dns.Msg) (time.Duration, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	negative := msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+	if negative {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return clampDuration(time.Duration(ttl) * time.Second, c.MinTTL, c.NegativeTTL), true
+			}
+		}
+		return 0, false
+	}
+
+	if msg.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+
+	var min uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || hdr.Ttl < min {
+				min = hdr.Ttl
+				found = true
+			}
+		}
+	}
+
+	return clampDuration(time.Duration(min) * time.Second, c.MinTTL, c.MaxTTL), true
+}
+
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d < min {
+		d = min
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+func (c *DnsCache) removeLocked(entry *dnsCacheEntry) {
+	c.lru.Remove(entry.elem)
+	delete(c.entries, entry.key)
+}
+
+// Flush drops all cached answers.
+func (c *DnsCache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*dnsCacheEntry, 0)
+	c.lru.Init()
+	c.mu.Unlock()
+
+	log.Print("DnsCache flushed\n")
+}
+
+func (c *DnsCache) Stats() DnsCacheStats {
+	c.mu.Lock()
+	n := len(c.entries)
+	c.mu.Unlock()
+
+	return DnsCacheStats{
+		Entries:n,
+		Hits:atomic.LoadUint64(&c.hits),
+		Misses:atomic.LoadUint64(&c.misses),
+		StaleHits:atomic.LoadUint64(&c.staleHits),
+		Prefetches:atomic.LoadUint64(&c.prefetches),
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func dnsTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestDnsCacheTTL(t *testing.T) {
+	soa := "example.com. 600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 %d"
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+		ns     []string
+		tc     bool
+		ttl    time.Duration
+		ok     bool
+	}{
+		{"smallest TTL", dns.RcodeSuccess, []string{"example.com. 300 IN A 1.2.3.4", "example.com. 120 IN A 1.2.3.5"}, nil, false, 120 * time.Second, true},
+		{"clamped to MinTTL", dns.RcodeSuccess, []string{"example.com. 1 IN A 1.2.3.4"}, nil, false, 5 * time.Second, true},
+		{"clamped to MaxTTL", dns.RcodeSuccess, []string{"example.com. 86400 IN A 1.2.3.4"}, nil, false, time.Hour, true},
+		{"NXDOMAIN with SOA minimum", dns.RcodeNameError, nil, []string{fmt.Sprintf(soa, 60)}, false, time.Minute, true},
+		{"NODATA with SOA TTL", dns.RcodeSuccess, nil, []string{fmt.Sprintf(soa, 3600)}, false, 5 * time.Minute, true},
+		{"NXDOMAIN without SOA", dns.RcodeNameError, nil, nil, false, 0, false},
+		{"SERVFAIL", dns.RcodeServerFailure, nil, nil, false, 0, false},
+		{"truncated", dns.RcodeSuccess, []string{"example.com. 300 IN A 1.2.3.4"}, nil, true, 0, false},
+	}
+
+	c := NewDnsCache(nil)
+	for _, tt := range tests {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Response, msg.Rcode, msg.Truncated = true, tt.rcode, tt.tc
+		for _, s := range tt.answer {
+			msg.Answer = append(msg.Answer, dnsTestRR(t, s))
+		}
+		for _, s := range tt.ns {
+			msg.Ns = append(msg.Ns, dnsTestRR(t, s))
+		}
+		// the OPT record has no TTL
+		msg.SetEdns0(4096, false)
+
+		ttl, ok := c.ttlOf(msg)
+		if ok != tt.ok || ttl != tt.ttl {
+			t.Errorf("%s: TTL %s %v, want %s %v", tt.name, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestDnsCacheServe(t *testing.T) {
+	queries := 0
+	next := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries++
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr:dns.RR_Header{Name:req.Question[0].Name, Rrtype:dns.TypeA, Class:dns.ClassINET, Ttl:300},
+			A:net.IPv4(1, 2, 3, 4),
+		})
+		w.WriteMsg(resp)
+	})
+	c := NewDnsCache(next)
+	c.MaxEntries = 2
+
+	tests := []struct {
+		name    string
+		qname   string
+		queries int
+	}{
+		{"miss", "a.example.com.", 1},
+		{"hit", "a.example.com.", 1},
+		{"hit in another case", "A.Example.COM.", 1},
+		{"second name", "b.example.com.", 2},
+		{"third name evicts the least recently used", "c.example.com.", 3},
+		{"second name is still cached", "b.example.com.", 3},
+		{"evicted name", "a.example.com.", 4},
+	}
+
+	for i, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		req.Id = uint16(i + 1)
+		w := newMsgWriter(nil)
+		c.ServeDNS(w, req)
+
+		if queries != tt.queries {
+			t.Errorf("%s: %d queries upstream, want %d", tt.name, queries, tt.queries)
+		}
+		if w.msg == nil || w.msg.Id != req.Id || len(w.msg.Answer) != 1 || w.msg.Question[0].Name != tt.qname {
+			t.Errorf("%s: bad answer %v", tt.name, w.msg)
+			continue
+		}
+		if ttl := w.msg.Answer[0].Header().Ttl; ttl > 300 || ttl < 299 {
+			t.Errorf("%s: TTL %d, want 300", tt.name, ttl)
+		}
+	}
+
+	if s := c.Stats(); s.Entries != 2 || s.Hits != 3 || s.Misses != 4 {
+		t.Errorf("Stats %s, want 2 entries, 3 hits and 4 misses", s.ToString())
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"github.com/miekg/dns"
+)
+
+var dnsBlockTTL uint32 = 60
+
+// hostsListLocalNames are the entries of the hosts-format lists mapping the
+// local names, they are not blocked
+var hostsListLocalNames = map[string]bool{
+	"localhost.":true,
+	"localhost.localdomain.":true,
+	"local.":true,
+	"broadcasthost.":true,
+	"ip6-localhost.":true,
+	"ip6-loopback.":true,
+	"0.0.0.0.":true,
+}
+
+// adblockCosmeticMarks start the element hiding rules of the adblock lists,
+// which hide parts of pages and don't block the domain before them
+var adblockCosmeticMarks = []string{"##", "#@#", "#?#", "#$#"}
+
+type DnsBlockMode int
+
+const (
+	DnsBlockNXDomain DnsBlockMode = iota // answer NXDOMAIN
+	DnsBlockNullIP                       // answer 0.0.0.0 or ::
+	DnsBlockSinkIP                       // answer SinkIPv4 or SinkIPv6
+)
+
+// domainList matches names against the entries of a blocklist or allowlist.
+type domainList struct {
+	hits    uint64
+
+	Name    string
+
+	// names matched exactly
+	exact   map[string]struct{}
+
+	// names matched with all their subdomains
+	domains map[string]struct{}
+
+	// names whose subdomains are matched, but not the name itself
+	subOnly map[string]struct{}
+}
+
+func newDomainList(name string) *domainList {
+	return &domainList{
+		Name:name,
+		exact:make(map[string]struct{}, 0),
+		domains:make(map[string]struct{}, 0),
+		subOnly:make(map[string]struct{}, 0),
+	}
+}
+
+// loadDomainList reads a list in hosts format ("0.0.0.0 name", exact match),
+// adblock format ("||name^", name and subdomains), wildcard format
+// ("*.name", subdomains only) or plain format ("name", name and subdomains).
+// Adblock exceptions ("@@||name^") are returned in a separate list.
+func loadDomainList(path string) (block *domainList, allow *domainList, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	name := filepath.Base(path)
+	block = newDomainList(name)
+	allow = newDomainList(name)
+
+	scanner := bufio.NewScanner(f)
+	Lines:for scanner.Scan() {
+		line := scanner.Text()
+
+		// The mark of an element hiding rule is in its first field, as in
+		// "example.com##.ad", after a space it starts a comment
+		if fields := strings.Fields(line); len(fields) > 0 {
+			for _, mark := range adblockCosmeticMarks {
+				if strings.Contains(fields[0], mark) {
+					continue Lines
+				}
+			}
+		}
+
+		line = strings.TrimSpace(stripComment(line, "#"))
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		list := block
+		if strings.HasPrefix(line, "@@") {
+			list = allow
+			line = line[2:]
+		}
+
+		if strings.HasPrefix(line, "||") {
+			line = line[2:]
+			if i := strings.IndexAny(line, "^/$"); i >= 0 {
+				line = line[:i]
+			}
+			list.domains[dns.Fqdn(strings.ToLower(line))] = struct{}{}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if net.ParseIP(fields[0]) != nil {
+			for _, n := range fields[1:] {
+				n = dns.Fqdn(strings.ToLower(n))
+				if !hostsListLocalNames[n] {
+					list.exact[n] = struct{}{}
+				}
+			}
+			continue
+		}
+
+		n := dns.Fqdn(strings.ToLower(fields[0]))
+		if strings.HasPrefix(n, "*.") {
+			list.subOnly[n[2:]] = struct{}{}
+		} else {
+			list.domains[n] = struct{}{}
+		}
+	}
+
+	return block, allow, scanner.Err()
+}
+
+func (l *domainList) size() int {
+	return len(l.exact) + len(l.domains) + len(l.subOnly)
+}
+
+// match checks name and each of its parent domains, so the cost depends on
+// the number of labels only.
+func (l *domainList) match(name string) bool {
+	if _, ok := l.exact[name]; ok {
+		return true
+	}
+	if _, ok := l.domains[name]; ok {
+		return true
+	}
+
+	for i := strings.Index(name, "."); i >= 0 && i < len(name) - 1; i = strings.Index(name, ".") {
+		name = name[i + 1:]
+		if _, ok := l.domains[name]; ok {
+			return true
+		}
+		if _, ok := l.subOnly[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DnsFilter is a dns.Handler that blocks names found in its blocklists,
+// unless they are in an allowlist, and forwards other queries to Next. Mode
+// and the sink addresses are changed with SetMode once queries are served.
+type DnsFilter struct {
+	Next     dns.Handler
+	Mode     DnsBlockMode
+	SinkIPv4 net.IP
+	SinkIPv6 net.IP
+
+	mu       sync.RWMutex
+	lists    []*domainList
+	allows   []*domainList
+}
+
+func NewDnsFilter(next dns.Handler) *DnsFilter {
+	return &DnsFilter{Next:next, Mode:DnsBlockNXDomain}
+}
+
+// SetMode sets how the blocked names are answered, sinkIPv4 and sinkIPv6 are
+// the addresses of DnsBlockSinkIP.
+func (f *DnsFilter) SetMode(mode DnsBlockMode, sinkIPv4, sinkIPv6 net.IP) {
+	f.mu.Lock()
+	f.Mode = mode
+	f.SinkIPv4 = sinkIPv4
+	f.SinkIPv6 = sinkIPv6
+	f.mu.Unlock()
+}
+
+func (f *DnsFilter) AddBlocklistFile(path string) error {
+	block, allow, err := loadDomainList(path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.lists = append(f.lists, block)
+	if allow.size() > 0 {
+		f.allows = append(f.allows, allow)
+	}
+	f.mu.Unlock()
+
+	log.Printf("Loaded %d blocked names from %s\n", block.size(), path)
+	return nil
+}
+
+func (f *DnsFilter) AddAllowlistFile(path string) error {
+	block, allow, err := loadDomainList(path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.allows = append(f.allows, block, allow)
+	f.mu.Unlock()
+	return nil
+}
+
+// Hits returns the number of blocked queries per blocklist.
+func (f *DnsFilter) Hits() map[string]uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	hits := make(map[string]uint64, len(f.lists))
+	for _, l := range f.lists {
+		hits[l.Name] += atomic.LoadUint64(&l.hits)
+	}
+	return hits
+}
+
+func (f *DnsFilter) GetDebugStats() string {
+	var ret string
+	for name, n := range f.Hits() {
+		ret += fmt.Sprintf("%s:%d\n", name, n)
+	}
+	return ret
+}
+
+// blockedBy returns the blocklist matching name, or nil if the name is not
+// blocked.
+func (f *DnsFilter) blockedBy(name string) *domainList {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, l := range f.allows {
+		if l.match(name) {
+			return nil
+		}
+	}
+	for _, l := range f.lists {
+		if l.match(name) {
+			return l
+		}
+	}
+	return nil
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (f *DnsFilter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		f.Next.ServeDNS(w, req)
+		return
+	}
+
+	q := req.Question[0]
+	l := f.blockedBy(strings.ToLower(q.Name))
+	if l == nil {
+		f.Next.ServeDNS(w, req)
+		return
+	}
+
+	atomic.AddUint64(&l.hits, 1)
+	log.Printf("Block %s by list %s\n", q.Name, l.Name)
+
+	f.mu.RLock()
+	mode, sinkIPv4, sinkIPv6 := f.Mode, f.SinkIPv4, f.SinkIPv6
+	f.mu.RUnlock()
+
+	resp := new(dns.Msg)
+	if mode == DnsBlockNXDomain {
+		resp.SetRcode(req, dns.RcodeNameError)
+		w.WriteMsg(resp)
+		return
+	}
+
+	resp.SetReply(req)
+	hdr := dns.RR_Header{Name:q.Name, Rrtype:q.Qtype, Class:dns.ClassINET, Ttl:dnsBlockTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		ip := net.IPv4zero.To4()
+		if mode == DnsBlockSinkIP {
+			ip = sinkIPv4.To4()
+		}
+		if ip != nil {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr:hdr, A:ip})
+		}
+	case dns.TypeAAAA:
+		ip := net.IPv6zero
+		if mode == DnsBlockSinkIP {
+			ip = sinkIPv6
+		}
+		if ip != nil {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr:hdr, AAAA:ip})
+		}
+	}
+	w.WriteMsg(resp)
+}
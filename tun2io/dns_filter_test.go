@@ -0,0 +1,82 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadDomainList(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`# hosts and plain entries with comments
+0.0.0.0 ads.example.com  ## tracker
+tracker.example.net ## seen on news sites
+plain.example.org # ads
+! adblock
+||adblock.example.info^$third-party
+@@||good.adblock.example.info^
+*.wild.example
+example.org##.banner
+##.sponsored
+cosmetic.example#@#.ad
+cosmetic.example#?#div:has(> .ad)
+cosmetic.example#$#.ad { display: none }
+`)
+	f.Close()
+
+	block, allow, err := loadDomainList(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		blocked bool
+		allowed bool
+	}{
+		{"ads.example.com.", true, false},
+		{"sub.ads.example.com.", false, false},
+		{"tracker.example.net.", true, false},
+		{"sub.tracker.example.net.", true, false},
+		{"plain.example.org.", true, false},
+		{"adblock.example.info.", true, false},
+		{"good.adblock.example.info.", true, true},
+		{"a.wild.example.", true, false},
+		{"wild.example.", false, false},
+
+		// element hiding rules don't block their domain
+		{"example.org.", false, false},
+		{"cosmetic.example.", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := block.match(tt.name); got != tt.blocked {
+			t.Errorf("%s blocked %t, want %t", tt.name, got, tt.blocked)
+		}
+		if got := allow.match(tt.name); got != tt.allowed {
+			t.Errorf("%s allowed %t, want %t", tt.name, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/miekg/dns"
+)
+
+// isHijackedDNS reports whether the flow id goes to port 53, so that it is
+// answered by the local DNS handler when hijacking is enabled.
+func isHijackedDNS(id TransportID) bool {
+	if id.Transport != header.TCPProtocolNumber && id.Transport != header.UDPProtocolNumber {
+		return false
+	}
+	return id.RemotePort == dnsPort
+}
+
+// DnsDialer is a proxy.Dialer that answers DNS queries with Handler instead
+// of connecting to the target, it is used to hijack port 53 flows: the tunnel
+// endpoint keeps the original resolver address, so the answers look like
+// they came from it.
+type DnsDialer struct {
+	Handler dns.Handler
+}
+
+func (d *DnsDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, errors.New("Unsupported network type")
+	}
+
+	local, remote := net.Pipe()
+	go d.serve(remote, addr, network == "tcp")
+	return local, nil
+}
+
+func (d *DnsDialer) serve(conn net.Conn, addr string, stream bool) {
+	defer conn.Close()
+
+	w := &dnsConnWriter{conn:conn, stream:stream}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		w.localAddr = &net.UDPAddr{IP:net.ParseIP(host)}
+		if p, err := strconv.Atoi(port); err == nil {
+			w.localAddr.Port = p
+		}
+	}
+
+	data := make([]byte, readBufSize)
+	for {
+		n, err := readDnsFrame(conn, data, stream)
+		if err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				log.Printf("DnsDialer read failed: %s\n", err)
+			}
+			return
+		}
+
+		serveDnsData(d.Handler, w, data[:n])
+	}
+}
+
+// serveDnsData unpacks a raw query and passes it to handler, malformed
+// queries are answered with FORMERR.
+func serveDnsData(handler dns.Handler, w dns.ResponseWriter, data []byte) {
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		x := new(dns.Msg)
+		x.SetRcodeFormatError(req)
+		w.WriteMsg(x)
+		return
+	}
+
+	if handler != nil {
+		handler.ServeDNS(w, req)
+	}
+}
+
+// dnsConnWriter writes DNS replies to a net.Conn, prefixed with the length
+// for stream connections.
+type dnsConnWriter struct {
+	conn      net.Conn
+	stream    bool
+	localAddr *net.UDPAddr
+}
+
+// WriteMsg implements the ResponseWriter.WriteMsg method.
+func (w *dnsConnWriter) WriteMsg(m *dns.Msg) (err error) {
+	var data []byte
+	data, err = m.Pack()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// Write implements the ResponseWriter.Write method.
+func (w *dnsConnWriter) Write(m []byte) (int, error) {
+	if err := writeDnsFrame(w.conn, m, w.stream); err != nil {
+		return 0, err
+	}
+	return len(m), nil
+}
+
+// LocalAddr implements the ResponseWriter.LocalAddr method.
+func (w *dnsConnWriter) LocalAddr() net.Addr {
+	if w.localAddr != nil {
+		return w.localAddr
+	}
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+func (w *dnsConnWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// TsigStatus implements the ResponseWriter.TsigStatus method.
+func (w *dnsConnWriter) TsigStatus() error { return nil }
+
+// TsigTimersOnly implements the ResponseWriter.TsigTimersOnly method.
+func (w *dnsConnWriter) TsigTimersOnly(b bool) {}
+
+// Hijack implements the ResponseWriter.Hijack method.
+func (w *dnsConnWriter) Hijack() {}
+
+// Close implements the ResponseWriter.Close method
+func (w *dnsConnWriter) Close() error {
+	return nil
+}
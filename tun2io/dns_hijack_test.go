@@ -0,0 +1,99 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/miekg/dns"
+)
+
+func TestIsHijackedDNS(t *testing.T) {
+	client, resolver := tcpip.Address("\xc0\xa8\x04\x02"), tcpip.Address("\x08\x08\x08\x08")
+	tests := []struct {
+		name string
+		id   TransportID
+		want bool
+	}{
+		{"UDP to 53", TransportID{header.UDPProtocolNumber, 40000, client, 53, resolver}, true},
+		{"TCP to 53", TransportID{header.TCPProtocolNumber, 40000, client, 53, resolver}, true},
+		{"IPv6 to 53", TransportID{header.UDPProtocolNumber, 40000, tcpip.Address(net.ParseIP("fd00::2")), 53, tcpip.Address(net.ParseIP("2001:4860:4860::8888"))}, true},
+		{"mDNS", TransportID{header.UDPProtocolNumber, 5353, client, 5353, resolver}, false},
+		{"DNS over TLS", TransportID{header.TCPProtocolNumber, 40000, client, 853, resolver}, false},
+		{"from 53", TransportID{header.UDPProtocolNumber, 53, client, 40000, resolver}, false},
+		{"other transport", TransportID{0, 40000, client, 53, resolver}, false},
+	}
+
+	for _, tt := range tests {
+		if got := isHijackedDNS(tt.id); got != tt.want {
+			t.Errorf("%s: hijacked %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDnsDialer(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 203.0.113.7")
+		resp.Answer = append(resp.Answer, rr)
+		resp.Extra = append(resp.Extra, &dns.TXT{
+			Hdr:dns.RR_Header{Name:"local.", Rrtype:dns.TypeTXT, Class:dns.ClassINET},
+			Txt:[]string{w.LocalAddr().String()},
+		})
+		w.WriteMsg(resp)
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := (&DnsDialer{Handler:handler}).Dial(network, "8.8.8.8:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		data, _ := req.Pack()
+		stream := network == "tcp"
+		if err := writeDnsFrame(conn, data, stream); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 512)
+		n, err := readDnsFrame(conn, buf, stream)
+		if err != nil {
+			t.Fatalf("%s: no reply: %s", network, err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Id != req.Id || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "203.0.113.7" {
+			t.Errorf("%s: bad reply %v", network, resp)
+		}
+		// the handler sees the original resolver as the local address
+		if len(resp.Extra) != 1 || resp.Extra[0].(*dns.TXT).Txt[0] != "8.8.8.8:53" {
+			t.Errorf("%s: local address %v, want 8.8.8.8:53", network, resp.Extra)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,347 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/miekg/dns"
+)
+
+var (
+	dnsHostsTTL uint32 = 60
+	dnsHostsReloadInterval = time.Second * 5
+
+	// CNAME chains inside the local records are followed at most this deep
+	dnsHostsMaxCNAME = 8
+)
+
+// DnsHosts is a dns.Handler that answers from static records loaded from a
+// hosts-format or zone file and forwards other names to Next. Names starting
+// with "*." match every name below them that has no records of its own.
+type DnsHosts struct {
+	Next      dns.Handler
+
+	mu        sync.RWMutex
+	records   map[string][]dns.RR
+	wildcards map[string][]dns.RR
+	path      string
+	modTime   time.Time
+	size      int64
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	closeOne  sync.Once
+}
+
+func NewDnsHosts(next dns.Handler) *DnsHosts {
+	h := &DnsHosts{
+		Next:next,
+		records:make(map[string][]dns.RR, 0),
+		wildcards:make(map[string][]dns.RR, 0),
+	}
+	h.ctx, h.ctxCancel = context.WithCancel(context.Background())
+	return h
+}
+
+// SetNext replaces Next while queries are served.
+func (h *DnsHosts) SetNext(next dns.Handler) {
+	h.mu.Lock()
+	h.Next = next
+	h.mu.Unlock()
+}
+
+// LoadFile loads the records from path and reloads them whenever the file
+// changes.
+func (h *DnsHosts) LoadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := h.load(path); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	watching := h.path != ""
+	h.path = path
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.mu.Unlock()
+
+	if !watching {
+		go h.watcher()
+	}
+	return nil
+}
+
+func (h *DnsHosts) watcher() {
+	Watching:for {
+		select {
+		case <-h.ctx.Done():
+			log.Printf("hosts watcher done because of '%s'", h.ctx.Err())
+			break Watching
+		case <-time.After(dnsHostsReloadInterval):
+			h.mu.RLock()
+			path, modTime, size := h.path, h.modTime, h.size
+			h.mu.RUnlock()
+
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue Watching
+			}
+
+			if err := h.load(path); err != nil {
+				log.Printf("Reload %s failed: %s\n", path, err)
+			} else {
+				log.Printf("Reloaded records from %s\n", path)
+			}
+
+			h.mu.Lock()
+			h.modTime = info.ModTime()
+			h.size = info.Size()
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *DnsHosts) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rrs []dns.RR
+	if isHostsFormat(data) {
+		rrs, err = parseHosts(data)
+	} else {
+		rrs, err = parseZone(data, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	records := make(map[string][]dns.RR, 0)
+	wildcards := make(map[string][]dns.RR, 0)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if strings.HasPrefix(name, "*.") {
+			wildcards[name[2:]] = append(wildcards[name[2:]], rr)
+		} else {
+			records[name] = append(records[name], rr)
+		}
+	}
+
+	h.mu.Lock()
+	h.records = records
+	h.wildcards = wildcards
+	h.mu.Unlock()
+	return nil
+}
+
+// isHostsFormat tells whether the first entry of data starts with an IP
+// address, as in /etc/hosts.
+func isHostsFormat(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(stripComment(scanner.Text(), "#;"))
+		if len(fields) == 0 {
+			continue
+		}
+		return net.ParseIP(fields[0]) != nil
+	}
+	return false
+}
+
+func stripComment(line string, marks string) string {
+	if i := strings.IndexAny(line, marks); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func parseHosts(data []byte) ([]dns.RR, error) {
+	var rrs []dns.RR
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(stripComment(scanner.Text(), "#"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("Bad hosts entry at line %d", lineno)
+		}
+
+		for _, name := range fields[1:] {
+			hdr := dns.RR_Header{Name:dns.Fqdn(name), Class:dns.ClassINET, Ttl:dnsHostsTTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr:hdr, A:ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr:hdr, AAAA:ip})
+			}
+		}
+	}
+
+	return rrs, scanner.Err()
+}
+
+func parseZone(data []byte, path string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	var err error
+
+	for t := range dns.ParseZone(bytes.NewReader(data), ".", path) {
+		if t.Error != nil {
+			if err == nil {
+				err = t.Error
+			}
+			continue
+		}
+
+		switch t.RR.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeSRV:
+			rrs = append(rrs, t.RR)
+		default:
+			log.Printf("Ignore unsupported record %s\n", t.RR.String())
+		}
+	}
+
+	return rrs, err
+}
+
+// lookup returns the records of name, from a wildcard entry if it has no
+// records of its own.
+func (h *DnsHosts) lookup(name string) []dns.RR {
+	name = strings.ToLower(name)
+	if rrs, ok := h.records[name]; ok {
+		return rrs
+	}
+
+	for i := strings.Index(name, "."); i >= 0 && i < len(name) - 1; i = strings.Index(name, ".") {
+		name = name[i + 1:]
+		if rrs, ok := h.wildcards[name]; ok {
+			return rrs
+		}
+	}
+	return nil
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (h *DnsHosts) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	h.mu.RLock()
+	next := h.Next
+	h.mu.RUnlock()
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		next.ServeDNS(w, req)
+		return
+	}
+
+	q := req.Question[0]
+
+	h.mu.RLock()
+	answer, target, found := h.resolve(q.Name, q.Qtype)
+	h.mu.RUnlock()
+
+	if !found {
+		next.ServeDNS(w, req)
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Answer = answer
+
+	// The chain ends on a name without local records, its records come
+	// from the next handler
+	if target != "" {
+		sub := req.Copy()
+		sub.Question[0].Name = target
+		mw := newMsgWriter(w)
+		next.ServeDNS(mw, sub)
+		if mw.msg != nil {
+			resp.Answer = append(resp.Answer, mw.msg.Answer...)
+			resp.Rcode = mw.msg.Rcode
+			resp.Authoritative = false
+		}
+	}
+	w.WriteMsg(resp)
+}
+
+// resolve collects the answer for name from the local records, following
+// CNAMEs, found is false if name has no local records at all. target is the
+// name a CNAME of the chain points to that has no local records, if any.
+func (h *DnsHosts) resolve(name string, qtype uint16) (answer []dns.RR, target string, found bool) {
+	for depth := 0; depth < dnsHostsMaxCNAME; depth++ {
+		rrs := h.lookup(name)
+		if rrs == nil {
+			if depth == 0 {
+				return nil, "", false
+			}
+			return answer, name, true
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == qtype || qtype == dns.TypeANY {
+				answer = append(answer, copyRRWithName(rr, name))
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+
+		if cname == nil || qtype == dns.TypeCNAME {
+			return answer, "", true
+		}
+
+		answer = append(answer, copyRRWithName(cname, name))
+		name = cname.Target
+	}
+
+	return answer, "", true
+}
+
+func copyRRWithName(rr dns.RR, name string) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
+}
+
+func (h *DnsHosts) Close() error {
+	h.closeOne.Do(func() {
+		h.ctxCancel()
+	})
+
+	return nil
+}
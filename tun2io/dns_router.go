@@ -0,0 +1,355 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	errUnknownDnsGroup = errors.New("Unknown DNS upstream group.")
+	errDnsIdMismatch = errors.New("DNS reply id mismatch.")
+)
+
+// DnsUpstream is a resolver reached over "udp", "tcp" or "https" (DNS over
+// HTTPS, Addr is the URL then). A nil Dialer connects directly.
+type DnsUpstream struct {
+	Network    string
+	Addr       string
+	Dialer     proxy.Dialer
+
+	// Timeout bounds each query, 5 seconds by default
+	Timeout    time.Duration
+
+	// client keeps the connections to a DNS over HTTPS upstream alive
+	// between the queries, it is created on the first one
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+func (u *DnsUpstream) dialer() proxy.Dialer {
+	if u.Dialer == nil {
+		return new(DirectDialer)
+	}
+	return u.Dialer
+}
+
+func (u *DnsUpstream) timeout() time.Duration {
+	if u.Timeout == 0 {
+		return defaultDNSQueryTimeout
+	}
+	return u.Timeout
+}
+
+func (u *DnsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return u.ExchangeContext(context.Background(), req)
+}
+
+// ExchangeContext is like Exchange, it gives up when ctx is done or after
+// Timeout.
+func (u *DnsUpstream) ExchangeContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+
+	data, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Network {
+	case "https":
+		data, err = u.exchangeHTTPS(ctx, data)
+	case "udp", "tcp":
+		data, err = u.exchangeConn(ctx, data)
+	default:
+		return nil, errors.New("Unsupported network type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(data); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *DnsUpstream) exchangeConn(ctx context.Context, data []byte) ([]byte, error) {
+	conn, err := u.dialer().Dial(u.Network, u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	stream := u.Network == "tcp"
+	if err := writeDnsFrame(conn, data, stream); err != nil {
+		return nil, err
+	}
+
+	// Datagrams of other queries, like late replies, are skipped
+	buf := make([]byte, readBufSize)
+	for {
+		n, err := readDnsFrame(conn, buf, stream)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && bytes.Equal(buf[:2], data[:2]) {
+			return buf[:n], nil
+		}
+		if stream {
+			return nil, errDnsIdMismatch
+		}
+	}
+}
+
+func (u *DnsUpstream) httpClient() *http.Client {
+	u.clientOnce.Do(func() {
+		u.client = &http.Client{
+			Transport:&http.Transport{Dial:u.dialer().Dial, MaxIdleConnsPerHost:2},
+			Timeout:u.timeout(),
+		}
+	})
+	return u.client
+}
+
+func (u *DnsUpstream) exchangeHTTPS(ctx context.Context, data []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", u.Addr, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	resp, err := u.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS failed: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, readBufSize))
+}
+
+// writeDnsFrame writes a DNS message to conn, prefixed with the length for
+// stream connections.
+func writeDnsFrame(conn net.Conn, data []byte, stream bool) error {
+	if stream {
+		buf := make([]byte, 2 + len(data))
+		binary.BigEndian.PutUint16(buf, uint16(len(data)))
+		copy(buf[2:], data)
+		data = buf
+	}
+
+	_, err := conn.Write(data)
+	return err
+}
+
+// readDnsFrame reads a DNS message written by writeDnsFrame into buf.
+func readDnsFrame(conn net.Conn, buf []byte, stream bool) (int, error) {
+	if !stream {
+		return conn.Read(buf)
+	}
+
+	var l uint16
+	if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+		return 0, err
+	}
+	if int(l) > len(buf) {
+		return 0, errBufferIsFull
+	}
+	return io.ReadFull(conn, buf[:l])
+}
+
+// DnsForwarder is a dns.Handler that forwards queries to the first of its
+// upstreams that answers.
+type DnsForwarder struct {
+	Upstreams []*DnsUpstream
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (f *DnsForwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	ctx := writerContext(w)
+	for _, u := range f.Upstreams {
+		resp, err := u.ExchangeContext(ctx, req)
+		if err != nil {
+			log.Printf("Query %s://%s failed: %s\n", u.Network, u.Addr, err)
+			continue
+		}
+
+		w.WriteMsg(resp)
+		return
+	}
+
+	x := new(dns.Msg)
+	x.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(x)
+}
+
+// DnsRoute sends the queries it matches to the upstream group named Group.
+// All criteria set must match, a name matches a suffix if it is the suffix
+// or one of its subdomains.
+type DnsRoute struct {
+	Suffixes []string
+	Regexp   *regexp.Regexp
+	Qtypes   []uint16
+	Group    string
+}
+
+func (r *DnsRoute) match(name string, qtype uint16) bool {
+	if len(r.Suffixes) > 0 {
+		found := false
+		for _, suffix := range r.Suffixes {
+			suffix = dns.Fqdn(strings.ToLower(suffix))
+			if name == suffix || strings.HasSuffix(name, "." + suffix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.Regexp != nil && !r.Regexp.MatchString(name) {
+		return false
+	}
+
+	if len(r.Qtypes) > 0 {
+		found := false
+		for _, t := range r.Qtypes {
+			if t == qtype {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DnsRouter is a dns.Handler that picks the upstream group of a query by the
+// first matching route. Each group has its own cache. Queries matching no
+// route go to the Default group, or to Fallback if there is none.
+type DnsRouter struct {
+	Default  string
+	Fallback dns.Handler
+
+	mu       sync.RWMutex
+	groups   map[string]*DnsCache
+	routes   []DnsRoute
+}
+
+func NewDnsRouter() *DnsRouter {
+	return &DnsRouter{groups:make(map[string]*DnsCache, 0)}
+}
+
+// AddGroup registers handler, usually a DnsForwarder, as the upstream group
+// name.
+func (r *DnsRouter) AddGroup(name string, handler dns.Handler) {
+	r.mu.Lock()
+	r.groups[name] = NewDnsCache(handler)
+	r.mu.Unlock()
+}
+
+func (r *DnsRouter) AddRoute(route DnsRoute) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.groups[route.Group]; !ok {
+		return errUnknownDnsGroup
+	}
+
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+// GroupCache returns the cache of the group name, or nil if there is no such
+// group.
+func (r *DnsRouter) GroupCache(name string) *DnsCache {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.groups[name]
+}
+
+func (r *DnsRouter) route(q dns.Question) dns.Handler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name := strings.ToLower(q.Name)
+	for i := range r.routes {
+		if r.routes[i].match(name, q.Qtype) {
+			return r.groups[r.routes[i].Group]
+		}
+	}
+
+	if g, ok := r.groups[r.Default]; ok {
+		return g
+	}
+	return r.Fallback
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (r *DnsRouter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	var h dns.Handler
+	if len(req.Question) == 1 {
+		h = r.route(req.Question[0])
+	} else {
+		h = r.Fallback
+	}
+
+	if h == nil {
+		x := new(dns.Msg)
+		x.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(x)
+		return
+	}
+
+	h.ServeDNS(w, req)
+}
@@ -0,0 +1,111 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDnsRouterRoute(t *testing.T) {
+	none := dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {})
+	r := NewDnsRouter()
+	r.Default = "public"
+	for _, name := range []string{"corp", "lan", "ipv6", "public"} {
+		r.AddGroup(name, none)
+	}
+	routes := []DnsRoute{
+		{Suffixes:[]string{"Corp.Example", "internal."}, Group:"corp"},
+		{Regexp:regexp.MustCompile(`^[a-z0-9-]+\.lan\.$`), Group:"lan"},
+		{Suffixes:[]string{"example.org"}, Qtypes:[]uint16{dns.TypeAAAA}, Group:"ipv6"},
+	}
+	for _, route := range routes {
+		if err := r.AddRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.AddRoute(DnsRoute{Suffixes:[]string{"example.net"}, Group:"other"}); err != errUnknownDnsGroup {
+		t.Errorf("Route to an unknown group: error %v, want %v", err, errUnknownDnsGroup)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		group string
+	}{
+		{"corp.example.", dns.TypeA, "corp"},
+		{"WWW.CORP.EXAMPLE.", dns.TypeA, "corp"},
+		{"host.internal.", dns.TypeMX, "corp"},
+		{"notcorp.example.", dns.TypeA, "public"},
+		{"printer.lan.", dns.TypeA, "lan"},
+		{"a.printer.lan.", dns.TypeA, "public"},
+		{"www.example.org.", dns.TypeAAAA, "ipv6"},
+		{"www.example.org.", dns.TypeA, "public"},
+		{"example.com.", dns.TypeA, "public"},
+	}
+
+	for _, tt := range tests {
+		h := r.route(dns.Question{Name:tt.name, Qtype:tt.qtype, Qclass:dns.ClassINET})
+		if h != dns.Handler(r.GroupCache(tt.group)) {
+			t.Errorf("%s %s: routed to the wrong group, want %s", tt.name, dns.TypeToString[tt.qtype], tt.group)
+		}
+	}
+}
+
+func TestDnsRouterFallback(t *testing.T) {
+	var served string
+	handler := func(name string) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			served = name
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			w.WriteMsg(resp)
+		})
+	}
+
+	r := NewDnsRouter()
+	r.AddGroup("corp", handler("corp"))
+	r.AddRoute(DnsRoute{Suffixes:[]string{"corp.example"}, Group:"corp"})
+
+	tests := []struct {
+		name     string
+		fallback dns.Handler
+		qname    string
+		served   string
+		rcode    int
+	}{
+		{"routed", nil, "www.corp.example.", "corp", dns.RcodeSuccess},
+		{"no route nor fallback", nil, "example.com.", "", dns.RcodeServerFailure},
+		{"fallback", handler("fallback"), "example.com.", "fallback", dns.RcodeSuccess},
+	}
+
+	for _, tt := range tests {
+		served = ""
+		r.Fallback = tt.fallback
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		w := newMsgWriter(nil)
+		r.ServeDNS(w, req)
+
+		if served != tt.served || w.msg == nil || w.msg.Rcode != tt.rcode {
+			t.Errorf("%s: served by %q with %v, want %q with rcode %d", tt.name, served, w.msg, tt.served, tt.rcode)
+		}
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"log"
 	"net"
 	"github.com/FTwOoO/netstack/tcpip"
+	"fmt"
+	"time"
 )
 
 type sessionWriter struct {
@@ -61,7 +63,7 @@ func (w *sessionWriter) LocalAddr() net.Addr {
 
 // RemoteAddr implements the ResponseWriter.RemoteAddr method.
 func (w *sessionWriter) RemoteAddr() net.Addr {
-	return &net.UDPAddr{IP:net.ParseIP(w.remoteAddr.Addr.String()), Port:int(w.remoteAddr.Port)}
+	return &net.UDPAddr{IP:net.IP(w.remoteAddr.Addr), Port:int(w.remoteAddr.Port)}
 }
 
 // TsigStatus implements the ResponseWriter.TsigStatus method.
@@ -78,21 +80,134 @@ func (w *sessionWriter) Close() error {
 	return nil
 }
 
+// msgWriter is a ResponseWriter that keeps the reply of a handler instead of
+// sending it, so handlers can be chained and their answers inspected.
+type msgWriter struct {
+	parent dns.ResponseWriter
+	msg    *dns.Msg
+
+	// ctx ends when the reply is no longer waited for, if set
+	ctx    context.Context
+}
+
+func newMsgWriter(parent dns.ResponseWriter) *msgWriter {
+	return &msgWriter{parent:parent}
+}
+
+// Context returns the context of the query, the one of the parent if the
+// writer has none.
+func (w *msgWriter) Context() context.Context {
+	if w.ctx != nil {
+		return w.ctx
+	}
+	return writerContext(w.parent)
+}
+
+// writerContext returns the context of the query answered through w, the
+// handlers stop waiting for their upstreams when it is done.
+func writerContext(w dns.ResponseWriter) context.Context {
+	if c, ok := w.(interface {
+		Context() context.Context
+	}); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// WriteMsg implements the ResponseWriter.WriteMsg method.
+func (w *msgWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write implements the ResponseWriter.Write method.
+func (w *msgWriter) Write(data []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0, err
+	}
+
+	w.msg = m
+	return len(data), nil
+}
+
+// LocalAddr implements the ResponseWriter.LocalAddr method.
+func (w *msgWriter) LocalAddr() net.Addr {
+	if w.parent != nil {
+		return w.parent.LocalAddr()
+	}
+	return &net.UDPAddr{IP:[]byte{}, Port:0, Zone:""}
+}
+
+// RemoteAddr implements the ResponseWriter.RemoteAddr method.
+func (w *msgWriter) RemoteAddr() net.Addr {
+	if w.parent != nil {
+		return w.parent.RemoteAddr()
+	}
+	return &net.UDPAddr{IP:[]byte{}, Port:0, Zone:""}
+}
+
+// TsigStatus implements the ResponseWriter.TsigStatus method.
+func (w *msgWriter) TsigStatus() error { return nil }
+
+// TsigTimersOnly implements the ResponseWriter.TsigTimersOnly method.
+func (w *msgWriter) TsigTimersOnly(b bool) {}
+
+// Hijack implements the ResponseWriter.Hijack method.
+func (w *msgWriter) Hijack() {}
+
+// Close implements the ResponseWriter.Close method
+func (w *msgWriter) Close() error {
+	return nil
+}
+
+
+type dnsCall struct {
+	done chan struct{}
+	msg  *dns.Msg
+}
 
 type DnsServer struct {
-	udpEp     *UdpEndpoint
-	Handler   dns.Handler
+	udpEp      *UdpEndpoint
+	Handler    dns.Handler
+
+	inflightMu sync.Mutex
+	inflight   map[string]*dnsCall
 
-	ctx       context.Context
-	ctxCancel context.CancelFunc
-	closeOne  sync.Once
+	// slots bounds the calls of Handler running, including the ones still
+	// running after their query timed out
+	slots      chan struct{}
+	timeout    time.Duration
+
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	closeOne   sync.Once
 }
 
 func CreateDnsServer(udpEp *UdpEndpoint, handler dns.Handler) (*DnsServer, error) {
-	d := &DnsServer{udpEp:udpEp, Handler:handler}
+	return CreateDnsServerWithConfig(udpEp, handler, nil)
+}
+
+// CreateDnsServerWithConfig is like CreateDnsServer with the query timeout
+// and the workers of config, the defaults if it is nil.
+func CreateDnsServerWithConfig(udpEp *UdpEndpoint, handler dns.Handler, config *Config) (*DnsServer, error) {
+	if config == nil {
+		defaults := Config{}.withDefaults()
+		config = &defaults
+	}
+
+	d := &DnsServer{
+		udpEp:udpEp,
+		Handler:handler,
+		inflight:make(map[string]*dnsCall, 0),
+		slots:make(chan struct{}, config.DNSWorkers),
+		timeout:config.DNSQueryTimeout,
+	}
 	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
 
-	go d.reader()
+	for i := 0; i < config.DNSWorkers; i++ {
+		go d.reader()
+	}
 	return d, nil
 }
 
@@ -101,23 +216,9 @@ func (d *DnsServer) reader() {
 		select {
 		case udpPacket := <-d.udpEp.RecvPackets:
 			w, _ := NewSessionWriter(udpPacket.Addr, d.udpEp.WritePackets)
-
-			req := new(dns.Msg)
-			err := req.Unpack(udpPacket.Data)
-			if err != nil {
-				x := new(dns.Msg)
-				x.SetRcodeFormatError(req)
-				w.WriteMsg(x)
-				w.Close()
-			}
-
-
-			if d.Handler != nil {
-				d.Handler.ServeDNS(w, req)
-			}
+			serveDnsData(d, w, udpPacket.Data)
 			w.Close()
 
-
 		case <-d.ctx.Done():
 			log.Printf("reader done because of '%s'", d.ctx.Err())
 			break Reading
@@ -125,6 +226,86 @@ func (d *DnsServer) reader() {
 	}
 }
 
+// ServeDNS implements the dns.Handler interface, it passes req to Handler and
+// answers SERVFAIL if no reply comes within its query timeout. Identical
+// questions asked at the same time share one call of Handler.
+func (d *DnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	var resp *dns.Msg
+	if len(req.Question) == 1 {
+		resp = d.exchangeShared(w, req)
+	} else {
+		resp = d.exchange(w, req)
+	}
+
+	if resp == nil {
+		x := new(dns.Msg)
+		x.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(x)
+		return
+	}
+
+	resp = resp.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	w.WriteMsg(resp)
+}
+
+func (d *DnsServer) exchangeShared(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	key := fmt.Sprintf("%s/%d/%t/%t", dnsCacheKey(req.Question[0]), req.Opcode, req.RecursionDesired, req.CheckingDisabled)
+
+	d.inflightMu.Lock()
+	if call, ok := d.inflight[key]; ok {
+		d.inflightMu.Unlock()
+		<-call.done
+		return call.msg
+	}
+
+	call := &dnsCall{done:make(chan struct{})}
+	d.inflight[key] = call
+	d.inflightMu.Unlock()
+
+	call.msg = d.exchange(w, req)
+
+	d.inflightMu.Lock()
+	delete(d.inflight, key)
+	d.inflightMu.Unlock()
+	close(call.done)
+
+	return call.msg
+}
+
+func (d *DnsServer) exchange(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	if d.Handler == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+	defer cancel()
+
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		log.Printf("DNS query %v timeout, no free worker\n", req.Question)
+		return nil
+	}
+
+	mw := newMsgWriter(w)
+	mw.ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		defer func() { <-d.slots }()
+		d.Handler.ServeDNS(mw, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return mw.msg
+	case <-ctx.Done():
+		log.Printf("DNS query %v timeout\n", req.Question)
+		return nil
+	}
+}
 
 func (d *DnsServer) Close(reason error) error {
 	d.closeOne.Do(func() {
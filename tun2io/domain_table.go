@@ -0,0 +1,154 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/miekg/dns"
+)
+
+var (
+	// mappings are kept at least this long, even if the answer TTL is shorter,
+	// since clients connect a while after resolving
+	domainTableMinTTL = time.Minute * 5
+
+	// the least recently used mappings are evicted beyond this size, even if
+	// they have not expired
+	domainTableMaxSize = 16384
+)
+
+type domainTableEntry struct {
+	addr   tcpip.Address
+	domain string
+	expire time.Time
+	elem   *list.Element
+}
+
+// DomainTable maps IP addresses to the domain names they were resolved from.
+type DomainTable struct {
+	mu      sync.Mutex
+	entries map[tcpip.Address]*domainTableEntry
+	lru     *list.List
+}
+
+func NewDomainTable() *DomainTable {
+	return &DomainTable{entries:make(map[tcpip.Address]*domainTableEntry, 0), lru:list.New()}
+}
+
+func ipToAddress(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.Address(ip4)
+	}
+	return tcpip.Address(ip.To16())
+}
+
+func (d *DomainTable) Add(ip net.IP, domain string, ttl time.Duration) {
+	if ttl < domainTableMinTTL {
+		ttl = domainTableMinTTL
+	}
+
+	now := time.Now()
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	addr := ipToAddress(ip)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[addr]; ok {
+		e.domain = domain
+		e.expire = now.Add(ttl)
+		d.lru.MoveToFront(e.elem)
+		return
+	}
+
+	// Expired mappings gather at the back, then the least recently used
+	// ones are evicted to make room
+	for d.lru.Len() > 0 {
+		e := d.lru.Back().Value.(*domainTableEntry)
+		if !now.After(e.expire) && len(d.entries) < domainTableMaxSize {
+			break
+		}
+		d.removeLocked(e)
+	}
+
+	e := &domainTableEntry{addr:addr, domain:domain, expire:now.Add(ttl)}
+	e.elem = d.lru.PushFront(e)
+	d.entries[addr] = e
+}
+
+func (d *DomainTable) removeLocked(e *domainTableEntry) {
+	d.lru.Remove(e.elem)
+	delete(d.entries, e.addr)
+}
+
+// Lookup returns the domain addr was resolved from, or "" if it is unknown.
+func (d *DomainTable) Lookup(addr tcpip.Address) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[addr]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(e.expire) {
+		d.removeLocked(e)
+		return ""
+	}
+	d.lru.MoveToFront(e.elem)
+	return e.domain
+}
+
+// DnsRecorder is a dns.Handler that records the addresses in the answers of
+// Next into Table.
+type DnsRecorder struct {
+	Next  dns.Handler
+	Table *DomainTable
+}
+
+// ServeDNS implements the dns.Handler interface.
+func (r *DnsRecorder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	mw := newMsgWriter(w)
+	r.Next.ServeDNS(mw, req)
+	if mw.msg == nil {
+		return
+	}
+
+	if len(req.Question) == 1 {
+		r.record(req.Question[0].Name, mw.msg)
+	}
+	w.WriteMsg(mw.msg)
+}
+
+// record maps the addresses of resp to the queried name, not to the CNAME
+// targets, since the client knows the flow by the name it asked for.
+func (r *DnsRecorder) record(name string, resp *dns.Msg) {
+	for _, rr := range resp.Answer {
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		switch a := rr.(type) {
+		case *dns.A:
+			r.Table.Add(a.A, name, ttl)
+		case *dns.AAAA:
+			r.Table.Add(a.AAAA, name, ttl)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	NetFlowV9 = 9
+	IPFIX = 10
+
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+)
+
+var (
+	errBadFlowVersion = errors.New("Flow export version must be 9 or 10.")
+
+	// templates are sent again this often, since the collector may have
+	// missed them or restarted
+	ipfixTemplateInterval = time.Minute
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// IPFIXExporter sends the closed flows to a collector over UDP, in NetFlow v9
+// or IPFIX format. Each tunnel is exported as two unidirectional flows, from
+// the client to the target and back. The domain and route of the tunnel have
+// no standard field and are only kept by FlowLogFile.
+type IPFIXExporter struct {
+	mu            sync.Mutex
+	version       uint16
+	conn          net.Conn
+	started       time.Time
+	sequence      uint32
+	templatesSent time.Time
+
+	// DomainID is the observation domain of IPFIX or the source ID of
+	// NetFlow v9
+	DomainID      uint32
+}
+
+func NewIPFIXExporter(collector string, version int) (*IPFIXExporter, error) {
+	if version != NetFlowV9 && version != IPFIX {
+		return nil, errBadFlowVersion
+	}
+
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPFIXExporter{version:uint16(version), conn:conn, started:time.Now()}, nil
+}
+
+func (e *IPFIXExporter) fields(v6 bool) []ipfixField {
+	var fields []ipfixField
+	if v6 {
+		fields = append(fields, ipfixField{27, 16}, ipfixField{28, 16})
+	} else {
+		fields = append(fields, ipfixField{8, 4}, ipfixField{12, 4})
+	}
+
+	// ports, protocolIdentifier, octetDeltaCount
+	fields = append(fields, ipfixField{7, 2}, ipfixField{11, 2}, ipfixField{4, 1}, ipfixField{1, 8})
+
+	if e.version == IPFIX {
+		// flowStartMilliseconds, flowEndMilliseconds
+		return append(fields, ipfixField{152, 8}, ipfixField{153, 8})
+	}
+	// FIRST_SWITCHED, LAST_SWITCHED in milliseconds of uptime
+	return append(fields, ipfixField{22, 4}, ipfixField{21, 4})
+}
+
+// appendSet appends a set with its header and padding to msg.
+func appendSet(msg []byte, id uint16, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	set := make([]byte, 4 + padded)
+	binary.BigEndian.PutUint16(set[0:], id)
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	copy(set[4:], body)
+	return append(msg, set...)
+}
+
+func (e *IPFIXExporter) templateSet() []byte {
+	var body []byte
+	for _, id := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+		fields := e.fields(id == ipfixTemplateIPv6)
+		rec := make([]byte, 4 + 4 * len(fields))
+		binary.BigEndian.PutUint16(rec[0:], id)
+		binary.BigEndian.PutUint16(rec[2:], uint16(len(fields)))
+		for i, f := range fields {
+			binary.BigEndian.PutUint16(rec[4 + 4 * i:], f.id)
+			binary.BigEndian.PutUint16(rec[6 + 4 * i:], f.length)
+		}
+		body = append(body, rec...)
+	}
+
+	setID := uint16(2)
+	if e.version == NetFlowV9 {
+		setID = 0
+	}
+	return appendSet(nil, setID, body)
+}
+
+func (e *IPFIXExporter) dataRecord(src, dst net.IP, srcPort, dstPort uint16, proto uint8, octets uint64, start, end time.Time) []byte {
+	var rec []byte
+	rec = append(rec, src...)
+	rec = append(rec, dst...)
+	rec = append(rec, byte(srcPort >> 8), byte(srcPort), byte(dstPort >> 8), byte(dstPort), proto)
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], octets)
+	rec = append(rec, b[:]...)
+
+	for _, t := range []time.Time{start, end} {
+		if e.version == IPFIX {
+			binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano() / int64(time.Millisecond)))
+			rec = append(rec, b[:]...)
+		} else {
+			binary.BigEndian.PutUint32(b[:], e.uptime(t))
+			rec = append(rec, b[:4]...)
+		}
+	}
+	return rec
+}
+
+func (e *IPFIXExporter) uptime(t time.Time) uint32 {
+	if t.Before(e.started) {
+		return 0
+	}
+	return uint32(t.Sub(e.started) / time.Millisecond)
+}
+
+// WriteFlow implements the FlowSink interface, only closed flows are
+// exported.
+func (e *IPFIXExporter) WriteFlow(r *FlowRecord) error {
+	if r.Event != FlowClose {
+		return nil
+	}
+
+	src, dst := r.SrcAddr.To4(), r.DstAddr.To4()
+	templateID := uint16(ipfixTemplateIPv4)
+	if src == nil || dst == nil {
+		src, dst = r.SrcAddr.To16(), r.DstAddr.To16()
+		templateID = ipfixTemplateIPv6
+	}
+
+	proto := uint8(ipProtoTCP)
+	if r.Network == "udp" {
+		proto = ipProtoUDP
+	}
+
+	end := time.Now()
+	if r.End != nil {
+		end = *r.End
+	}
+
+	var data []byte
+	data = append(data, e.dataRecord(src, dst, r.SrcPort, r.DstPort, proto, r.BytesSent, r.Start, end)...)
+	data = append(data, e.dataRecord(dst, src, r.DstPort, r.SrcPort, proto, r.BytesReceived, r.Start, end)...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	count := 2
+	headerSize := 16
+	if e.version == NetFlowV9 {
+		headerSize = 20
+	}
+	msg := make([]byte, headerSize)
+	if now.Sub(e.templatesSent) >= ipfixTemplateInterval {
+		msg = append(msg, e.templateSet()...)
+		e.templatesSent = now
+		count += 2
+	}
+	msg = appendSet(msg, templateID, data)
+
+	if e.version == IPFIX {
+		// the sequence counts the data records sent before this message
+		binary.BigEndian.PutUint16(msg[0:], IPFIX)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[8:], e.sequence)
+		binary.BigEndian.PutUint32(msg[12:], e.DomainID)
+		e.sequence += 2
+	} else {
+		// the sequence counts the packets
+		binary.BigEndian.PutUint16(msg[0:], NetFlowV9)
+		binary.BigEndian.PutUint16(msg[2:], uint16(count))
+		binary.BigEndian.PutUint32(msg[4:], e.uptime(now))
+		binary.BigEndian.PutUint32(msg[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[12:], e.sequence)
+		binary.BigEndian.PutUint32(msg[16:], e.DomainID)
+		e.sequence++
+	}
+
+	_, err := e.conn.Write(msg)
+	return err
+}
+
+// Close implements the FlowSink interface.
+func (e *IPFIXExporter) Close() error {
+	return e.conn.Close()
+}
@@ -0,0 +1,191 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// readFlowMessage reads the next export message received by collector.
+func readFlowMessage(t *testing.T, collector net.PacketConn) []byte {
+	buf := make([]byte, 65536)
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No export message received: %s", err)
+	}
+	return buf[:n]
+}
+
+// flowSets returns the sets of an export message by their id.
+func flowSets(t *testing.T, msg []byte, headerSize int) map[uint16][]byte {
+	sets := make(map[uint16][]byte, 0)
+	for off := headerSize; off < len(msg); {
+		if off + 4 > len(msg) {
+			t.Fatalf("Truncated set header at %d", off)
+		}
+		id, l := binary.BigEndian.Uint16(msg[off:]), int(binary.BigEndian.Uint16(msg[off + 2:]))
+		if l < 4 || off + l > len(msg) || l % 4 != 0 {
+			t.Fatalf("Bad length %d of set %d", l, id)
+		}
+		sets[id] = msg[off + 4:off + l]
+		off += l
+	}
+	return sets
+}
+
+func TestIPFIXExporter(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    int
+		headerSize int
+		templateID uint16
+		recordSize int
+	}{
+		{"IPFIX", IPFIX, 16, 2, 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8},
+		{"NetFlowV9", NetFlowV9, 20, 0, 4 + 4 + 2 + 2 + 1 + 8 + 4 + 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer collector.Close()
+
+			e, err := NewIPFIXExporter(collector.LocalAddr().String(), tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			e.DomainID = 7
+
+			start := time.Now().Add(-time.Second)
+			end := start.Add(time.Second)
+			r := &FlowRecord{
+				Event:FlowClose,
+				Start:start,
+				End:&end,
+				Network:"tcp",
+				SrcAddr:net.IP{192, 168, 4, 2},
+				SrcPort:40000,
+				DstAddr:net.IP{93, 184, 216, 34},
+				DstPort:443,
+				BytesSent:1000,
+				BytesReceived:20000,
+			}
+
+			// Open events are not exported
+			if err := e.WriteFlow(&FlowRecord{Event:FlowOpen}); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.WriteFlow(r); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := readFlowMessage(t, collector)
+			if v := binary.BigEndian.Uint16(msg); int(v) != tt.version {
+				t.Fatalf("Version %d, want %d", v, tt.version)
+			}
+			if tt.version == IPFIX && int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+				t.Fatalf("Length %d, message of %d bytes", binary.BigEndian.Uint16(msg[2:]), len(msg))
+			}
+			if id := binary.BigEndian.Uint32(msg[tt.headerSize - 4:]); id != 7 {
+				t.Fatalf("Domain %d, want 7", id)
+			}
+
+			sets := flowSets(t, msg, tt.headerSize)
+			if _, ok := sets[tt.templateID]; !ok {
+				t.Fatalf("No template set in the first message")
+			}
+			data, ok := sets[ipfixTemplateIPv4]
+			if !ok || len(data) < 2 * tt.recordSize {
+				t.Fatalf("Data set of %d bytes, want 2 records of %d", len(data), tt.recordSize)
+			}
+
+			// client to target, then target to client
+			for i, want := range []struct {
+				src, dst net.IP
+				octets   uint64
+			}{{r.SrcAddr, r.DstAddr, r.BytesSent}, {r.DstAddr, r.SrcAddr, r.BytesReceived}} {
+				rec := data[i * tt.recordSize:]
+				if !net.IP(rec[0:4]).Equal(want.src) || !net.IP(rec[4:8]).Equal(want.dst) {
+					t.Errorf("Record %d is %v -> %v", i, net.IP(rec[0:4]), net.IP(rec[4:8]))
+				}
+				if rec[12] != ipProtoTCP {
+					t.Errorf("Record %d has protocol %d", i, rec[12])
+				}
+				if octets := binary.BigEndian.Uint64(rec[13:]); octets != want.octets {
+					t.Errorf("Record %d has %d octets, want %d", i, octets, want.octets)
+				}
+			}
+
+			// The templates are only sent again after ipfixTemplateInterval
+			if err := e.WriteFlow(r); err != nil {
+				t.Fatal(err)
+			}
+			if sets := flowSets(t, readFlowMessage(t, collector), tt.headerSize); len(sets) != 1 {
+				t.Errorf("Second message has %d sets, want the data set only", len(sets))
+			}
+		})
+	}
+}
+
+func TestIPFIXExporterIPv6(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	e, err := NewIPFIXExporter(collector.LocalAddr().String(), IPFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	r := &FlowRecord{
+		Event:FlowClose,
+		Network:"udp",
+		SrcAddr:net.ParseIP("fd00::2"),
+		SrcPort:5353,
+		DstAddr:net.ParseIP("2001:db8::1"),
+		DstPort:53,
+	}
+	if err := e.WriteFlow(r); err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok := flowSets(t, readFlowMessage(t, collector), 16)[ipfixTemplateIPv6]
+	if !ok || len(data) < 16 + 16 + 5 {
+		t.Fatalf("No IPv6 data set")
+	}
+	if !net.IP(data[0:16]).Equal(r.SrcAddr) || data[36] != ipProtoUDP {
+		t.Errorf("First record is %v protocol %d", net.IP(data[0:16]), data[36])
+	}
+}
+
+func TestNewIPFIXExporterVersion(t *testing.T) {
+	if _, err := NewIPFIXExporter("127.0.0.1:4739", 5); err != errBadFlowVersion {
+		t.Errorf("Version 5 gave %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// the tunnel was connected
+	FlowOpen = "open"
+
+	// the tunnel was closed, or could not be opened
+	FlowClose = "close"
+)
+
+// FlowRecord describes a tunnel when it is opened and when it is closed.
+type FlowRecord struct {
+	Event         string     `json:"event"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end,omitempty"`
+	Network       string     `json:"network"`
+	SrcAddr       net.IP     `json:"src_addr"`
+	SrcPort       uint16     `json:"src_port"`
+	DstAddr       net.IP     `json:"dst_addr"`
+	DstPort       uint16     `json:"dst_port"`
+	Domain        string     `json:"domain,omitempty"`
+	Protocol      string     `json:"protocol,omitempty"`
+	Route         string     `json:"route,omitempty"`
+	BytesSent     uint64     `json:"bytes_sent"`
+	BytesReceived uint64     `json:"bytes_received"`
+	Reason        string     `json:"reason,omitempty"`
+}
+
+func newFlowRecord(t *Tunnel, event string, reason error) *FlowRecord {
+	r := &FlowRecord{
+		Event:event,
+		Start:t.Started,
+		Network:t.Id.Network(),
+		SrcAddr:net.IP(t.Id.SrcAddress),
+		SrcPort:t.Id.SrcPort,
+		DstAddr:net.IP(t.Id.RemoteAddress),
+		DstPort:t.Id.RemotePort,
+		Domain:t.Domain,
+		Protocol:t.Protocol(),
+		Route:t.Route,
+		BytesSent:t.BytesSent(),
+		BytesReceived:t.BytesReceived(),
+	}
+
+	// End is set only for the closed flows, so that the open ones have no
+	// end in JSON
+	if event == FlowClose {
+		end := t.Ended
+		if end.IsZero() {
+			end = time.Now()
+		}
+		r.End = &end
+	}
+	if reason != nil {
+		r.Reason = reason.Error()
+	}
+	return r
+}
+
+// FlowSink receives the flow records of the manager, WriteFlow is called from
+// the goroutines of the tunnels and must not block for long.
+type FlowSink interface {
+	WriteFlow(r *FlowRecord) error
+	Close() error
+}
+
+// FlowLogFile writes flow records as JSON lines. When the file reaches
+// maxSize bytes it is renamed to path.1, the older ones are shifted up to
+// path.<maxFiles-1> and a new file is started. A maxSize of 0 disables the
+// rotation.
+type FlowLogFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewFlowLogFile(path string, maxSize int64, maxFiles int) (*FlowLogFile, error) {
+	f := &FlowLogFile{path:path, maxSize:maxSize, maxFiles:maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FlowLogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// WriteFlow implements the FlowSink interface.
+func (f *FlowLogFile) WriteFlow(r *FlowRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return errDeviceClosed
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size + int64(len(line)) > f.maxSize {
+		f.file.Close()
+		f.file = nil
+		rotateFiles(f.path, f.maxFiles)
+		if f.maxFiles <= 1 {
+			os.Remove(f.path)
+		}
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// Close implements the FlowSink interface.
+func (f *FlowLogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,86 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip/header"
+)
+
+func TestFlowLogFileEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewFlowLogFile(filepath.Join(dir, "flows.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := &Tunnel{
+		Id:TransportID{header.TCPProtocolNumber, 40000, "\xc0\xa8\x04\x02", 443, "\x5d\xb8\xd8\x22"},
+		Started:time.Now(),
+	}
+	if err := f.WriteFlow(newFlowRecord(tunnel, FlowOpen, nil)); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.Ended = time.Now()
+	if err := f.WriteFlow(newFlowRecord(tunnel, FlowClose, errors.New("EOF"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	file, err := os.Open(filepath.Join(dir, "flows.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Bad record %q: %s", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+
+	if end, ok := records[0]["end"]; ok {
+		t.Errorf("Open record has end %v", end)
+	}
+	end, ok := records[1]["end"].(string)
+	if !ok {
+		t.Fatalf("Close record has no end: %v", records[1])
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, end); err != nil || !ts.Equal(tunnel.Ended) {
+		t.Errorf("Close record ends at %s, want %s", end, tunnel.Ended.Format(time.RFC3339Nano))
+	}
+}
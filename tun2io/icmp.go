@@ -0,0 +1,217 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"github.com/FTwOoO/netstack/tcpip"
+)
+
+type ICMPPolicy int
+
+const (
+	ICMPIgnore  ICMPPolicy = iota // leave the echo requests to the stack, which drops them
+	ICMPReply                     // answer all echo requests locally
+	ICMPForward                   // send the echo requests with ICMP datagram sockets
+)
+
+const (
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+	icmpHeaderSize = 8
+	defaultTTL = 64
+
+	// ICMPv6 errors must fit in the minimum IPv6 MTU
+	ipv6MinMTU = 1280
+
+	ipProtoICMP = 1
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+	ipProtoICMPv6 = 58
+
+	icmpEchoReply = 0
+	icmpEchoRequest = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply = 129
+)
+
+// checksum computes the internet checksum of data, starting from sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum >> 16 + sum & 0xffff
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeaderSum(src, dst tcpip.Address, proto uint8, length int) uint32 {
+	var sum uint32
+	for _, a := range []tcpip.Address{src, dst} {
+		for i := 0; i + 1 < len(a); i += 2 {
+			sum += uint32(a[i]) << 8 | uint32(a[i + 1])
+		}
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// buildIPv4 builds an IPv4 packet carrying payload.
+func buildIPv4(src, dst tcpip.Address, proto uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv4HeaderSize + len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = defaultTTL
+	pkt[9] = proto
+	copy(pkt[12:16], src)
+	copy(pkt[16:20], dst)
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:ipv4HeaderSize], 0))
+	copy(pkt[ipv4HeaderSize:], payload)
+	return pkt
+}
+
+// buildIPv6 builds an IPv6 packet carrying payload.
+func buildIPv6(src, dst tcpip.Address, proto uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv6HeaderSize + len(payload))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = defaultTTL
+	copy(pkt[8:24], src)
+	copy(pkt[24:40], dst)
+	copy(pkt[ipv6HeaderSize:], payload)
+	return pkt
+}
+
+// buildPortUnreachable builds the ICMP or ICMPv6 port unreachable packet
+// telling client that the UDP port of target is closed, transport is the UDP
+// packet the client sent.
+func buildPortUnreachable(client, target tcpip.Address, transport []byte) []byte {
+	if len(client) == 4 {
+		// quote the original IP header and the first 8 bytes of its payload
+		orig := buildIPv4(client, target, ipProtoUDP, transport)
+		if len(orig) > ipv4HeaderSize + 8 {
+			orig = orig[:ipv4HeaderSize + 8]
+		}
+
+		msg := make([]byte, icmpHeaderSize + len(orig))
+		msg[0] = 3 // destination unreachable
+		msg[1] = 3 // port unreachable
+		copy(msg[icmpHeaderSize:], orig)
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg, 0))
+		return buildIPv4(target, client, ipProtoICMP, msg)
+	}
+
+	orig := buildIPv6(client, target, ipProtoUDP, transport)
+	if max := ipv6MinMTU - ipv6HeaderSize - icmpHeaderSize; len(orig) > max {
+		orig = orig[:max]
+	}
+
+	msg := make([]byte, icmpHeaderSize + len(orig))
+	msg[0] = 1 // destination unreachable
+	msg[1] = 4 // port unreachable
+	copy(msg[icmpHeaderSize:], orig)
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg, pseudoHeaderSum(target, client, ipProtoICMPv6, len(msg))))
+	return buildIPv6(target, client, ipProtoICMPv6, msg)
+}
+
+// icmpEcho is an ICMP or ICMPv6 echo request from client to target.
+type icmpEcho struct {
+	client tcpip.Address
+	target tcpip.Address
+	id     uint16
+	seq    uint16
+	data   []byte
+}
+
+// parseEchoRequest returns the echo request carried by pkt, fragments and
+// IPv6 packets with extension headers are not parsed.
+func parseEchoRequest(pkt []byte) (e icmpEcho, ok bool) {
+	var msg []byte
+	if len(pkt) >= ipv4HeaderSize && pkt[0] >> 4 == 4 {
+		ihl := int(pkt[0] & 0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if pkt[9] != ipProtoICMP || binary.BigEndian.Uint16(pkt[6:8]) & 0x3fff != 0 || total > len(pkt) || ihl > total {
+			return e, false
+		}
+
+		msg = pkt[ihl:total]
+		if len(msg) < icmpHeaderSize || msg[0] != icmpEchoRequest || msg[1] != 0 {
+			return e, false
+		}
+		e.client, e.target = tcpip.Address(pkt[12:16]), tcpip.Address(pkt[16:20])
+	} else if len(pkt) >= ipv6HeaderSize && pkt[0] >> 4 == 6 {
+		msg = pkt[ipv6HeaderSize:]
+		if length := int(binary.BigEndian.Uint16(pkt[4:6])); length < len(msg) {
+			msg = msg[:length]
+		}
+		if pkt[6] != ipProtoICMPv6 || len(msg) < icmpHeaderSize || msg[0] != icmpv6EchoRequest || msg[1] != 0 {
+			return e, false
+		}
+		e.client, e.target = tcpip.Address(pkt[8:24]), tcpip.Address(pkt[24:40])
+	} else {
+		return e, false
+	}
+
+	e.id = binary.BigEndian.Uint16(msg[4:6])
+	e.seq = binary.BigEndian.Uint16(msg[6:8])
+	e.data = msg[icmpHeaderSize:]
+	return e, true
+}
+
+// mayBeEchoRequest reports whether hdr, the start of a packet, can be an
+// echo request, so that the other packets go to the stack without being
+// flattened. It is true when hdr is too short to tell.
+func mayBeEchoRequest(hdr []byte) bool {
+	switch {
+	case len(hdr) >= ipv4HeaderSize && hdr[0] >> 4 == 4:
+		ihl := int(hdr[0] & 0x0f) * 4
+		return hdr[9] == ipProtoICMP && (len(hdr) <= ihl || hdr[ihl] == icmpEchoRequest)
+	case len(hdr) >= ipv6HeaderSize && hdr[0] >> 4 == 6:
+		return hdr[6] == ipProtoICMPv6 && (len(hdr) == ipv6HeaderSize || hdr[ipv6HeaderSize] == icmpv6EchoRequest)
+	}
+	return len(hdr) < ipv6HeaderSize
+}
+
+// buildEchoMessage builds the ICMP message of type typ for e, without the
+// ICMPv6 checksum which needs the addresses.
+func buildEchoMessage(typ uint8, e icmpEcho) []byte {
+	msg := make([]byte, icmpHeaderSize + len(e.data))
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], e.id)
+	binary.BigEndian.PutUint16(msg[6:], e.seq)
+	copy(msg[icmpHeaderSize:], e.data)
+	return msg
+}
+
+// buildEchoReply builds the echo reply of target to the request e of client.
+func buildEchoReply(e icmpEcho) []byte {
+	if len(e.client) == 4 {
+		msg := buildEchoMessage(icmpEchoReply, e)
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg, 0))
+		return buildIPv4(e.target, e.client, ipProtoICMP, msg)
+	}
+
+	msg := buildEchoMessage(icmpv6EchoReply, e)
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg, pseudoHeaderSum(e.target, e.client, ipProtoICMPv6, len(msg))))
+	return buildIPv6(e.target, e.client, ipProtoICMPv6, msg)
+}
@@ -0,0 +1,231 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+)
+
+// icmpLogInterval is the least time between two logs of failed forwards, a
+// ping sends a request every second for as long as it runs
+const icmpLogInterval = 10 * time.Second
+
+var (
+	errICMPNotRouted = errors.New("ICMP forwarding needs a socket mark or a device.")
+)
+
+// icmpFlowKey identifies the echo requests of a ping command.
+type icmpFlowKey struct {
+	client tcpip.Address
+	target tcpip.Address
+	id     uint16
+}
+
+type icmpFlow struct {
+	conn     net.PacketConn
+	lastSeen time.Time
+}
+
+// icmpForwarder sends the echo requests of the clients with ICMP datagram
+// sockets, one per flow, and relays the replies with the id of the client.
+// The kernel allows them to the groups of net.ipv4.ping_group_range.
+//
+// The sockets are marked with mark or bound to device, one of them keeps
+// the requests from being routed back into the tun and forwarded again.
+type icmpForwarder struct {
+	mu         sync.Mutex
+	flows      map[icmpFlowKey]*icmpFlow
+	mark       int
+	device     string
+	timeout    time.Duration
+
+	lastLog    time.Time
+	suppressed int
+}
+
+// newICMPForwarder returns a forwarder closing the sockets idle for timeout.
+func newICMPForwarder(timeout time.Duration) *icmpForwarder {
+	return &icmpForwarder{flows:make(map[icmpFlowKey]*icmpFlow, 0), timeout:timeout}
+}
+
+func (f *icmpForwarder) setMark(mark int) {
+	f.mu.Lock()
+	f.mark = mark
+	f.mu.Unlock()
+}
+
+func (f *icmpForwarder) setDevice(device string) {
+	f.mu.Lock()
+	f.device = device
+	f.mu.Unlock()
+}
+
+// logFailure logs the failure err to forward e, at most once per
+// icmpLogInterval.
+func (f *icmpForwarder) logFailure(e icmpEcho, err error) {
+	f.mu.Lock()
+	if time.Since(f.lastLog) < icmpLogInterval {
+		f.suppressed++
+		f.mu.Unlock()
+		return
+	}
+	suppressed := f.suppressed
+	f.lastLog, f.suppressed = time.Now(), 0
+	f.mu.Unlock()
+
+	log.Printf("Forward ICMP echo to %v failed: %s, %d failures not logged\n", net.IP(e.target), err, suppressed)
+}
+
+// listenICMP opens an ICMP or ICMPv6 datagram socket, marked with mark if it
+// is not 0 and bound to device if it is not empty.
+func listenICMP(ipv6 bool, mark int, device string) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if ipv6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM | syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if device != "" {
+		if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+
+	// The socket is seen as a UDP one, with the echo id as its port
+	file := os.NewFile(uintptr(fd), "icmp")
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// forward sends the echo request e, write is called with the IP packets of
+// the replies.
+func (f *icmpForwarder) forward(e icmpEcho, write func([]byte)) error {
+	key := icmpFlowKey{client:e.client, target:e.target, id:e.id}
+	ipv6 := len(e.client) == net.IPv6len
+
+	f.mu.Lock()
+	if f.flows == nil {
+		f.mu.Unlock()
+		return errDeviceClosed
+	}
+	flow := f.flows[key]
+	if flow == nil {
+		// Without them the request goes back into the tun when it has the
+		// default routes, and is forwarded again
+		if f.mark == 0 && f.device == "" {
+			f.mu.Unlock()
+			return errICMPNotRouted
+		}
+
+		conn, err := listenICMP(ipv6, f.mark, f.device)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+
+		flow = &icmpFlow{conn:conn}
+		f.flows[key] = flow
+		go f.relay(key, flow, write)
+	}
+	flow.lastSeen = time.Now()
+	f.mu.Unlock()
+
+	// The kernel sets the id and the checksum
+	typ := uint8(icmpEchoRequest)
+	if ipv6 {
+		typ = icmpv6EchoRequest
+	}
+	_, err := flow.conn.WriteTo(buildEchoMessage(typ, e), &net.UDPAddr{IP:net.IP(e.target)})
+	return err
+}
+
+// relay writes the replies read on flow until it is idle for f.timeout.
+func (f *icmpForwarder) relay(key icmpFlowKey, flow *icmpFlow, write func([]byte)) {
+	replyType := uint8(icmpEchoReply)
+	if len(key.client) == net.IPv6len {
+		replyType = icmpv6EchoReply
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		flow.conn.SetReadDeadline(time.Now().Add(f.timeout))
+		n, _, err := flow.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !f.expired(flow) {
+				continue
+			}
+			break
+		}
+
+		msg := buf[:n]
+		if len(msg) < icmpHeaderSize || msg[0] != replyType {
+			continue
+		}
+
+		data := append([]byte{}, msg[icmpHeaderSize:]...)
+		seq := binary.BigEndian.Uint16(msg[6:8])
+		write(buildEchoReply(icmpEcho{client:key.client, target:key.target, id:key.id, seq:seq, data:data}))
+	}
+
+	f.mu.Lock()
+	if f.flows[key] == flow {
+		delete(f.flows, key)
+	}
+	f.mu.Unlock()
+	flow.conn.Close()
+}
+
+// close closes the sockets of all the flows, the requests forwarded later
+// are refused.
+func (f *icmpForwarder) close() {
+	f.mu.Lock()
+	flows := f.flows
+	f.flows = nil
+	f.mu.Unlock()
+
+	// Their relays end on the closed sockets
+	for _, flow := range flows {
+		flow.conn.Close()
+	}
+}
+
+func (f *icmpForwarder) expired(flow *icmpFlow) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(flow.lastSeen) >= f.timeout
+}
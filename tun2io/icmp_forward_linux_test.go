@@ -0,0 +1,96 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+)
+
+func TestICMPForwarderClose(t *testing.T) {
+	enterNetns(t)
+
+	// The range of the new namespace allows no group, root is the one mapped
+	// in a user namespace
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ping_group_range", []byte("0 0"), 0644); err != nil {
+		t.Skipf("No ICMP datagram sockets: %s", err)
+	}
+	c, err := newNetlinkConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setLink(lo.Index, 0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newICMPForwarder(time.Minute)
+	e := icmpEcho{
+		client:tcpip.Address(net.IPv4(192, 168, 4, 2).To4()),
+		target:tcpip.Address(net.IPv4(127, 0, 0, 1).To4()),
+		id:0x1234,
+		seq:1,
+		data:[]byte("ping"),
+	}
+	replies := make(chan []byte, 1)
+	write := func(pkt []byte) { replies <- pkt }
+
+	if err := f.forward(e, write); err != errICMPNotRouted {
+		t.Fatalf("Forward without mark or device: error %v, want %v", err, errICMPNotRouted)
+	}
+
+	f.setDevice("lo")
+	if err := f.forward(e, write); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkt := <-replies:
+		if string(pkt) != string(buildEchoReply(e)) {
+			t.Errorf("Reply % x, want % x", pkt, buildEchoReply(e))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No echo reply")
+	}
+
+	f.mu.Lock()
+	var conn net.PacketConn
+	for _, flow := range f.flows {
+		conn = flow.conn
+	}
+	f.mu.Unlock()
+	if conn == nil {
+		t.Fatal("No flow for the echo request")
+	}
+
+	f.close()
+	if _, err := conn.WriteTo([]byte{8, 0, 0, 0, 0, 0, 0, 0}, &net.UDPAddr{IP:net.IPv4(127, 0, 0, 1)}); err == nil {
+		t.Errorf("Socket of the flow still open after close")
+	}
+	if err := f.forward(e, write); err != errDeviceClosed {
+		t.Errorf("Forward after close: error %v, want %v", err, errDeviceClosed)
+	}
+}
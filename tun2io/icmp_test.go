@@ -0,0 +1,185 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/FTwOoO/netstack/tcpip"
+)
+
+var (
+	echoClient4 = tcpip.Address(net.IPv4(10, 0, 0, 2).To4())
+	echoTarget4 = tcpip.Address(net.IPv4(8, 8, 8, 8).To4())
+	echoClient6 = tcpip.Address(net.ParseIP("fd00::2"))
+	echoTarget6 = tcpip.Address(net.ParseIP("2001:4860:4860::8888"))
+)
+
+// buildEchoRequest builds the packet of the echo request e, as a client
+// sends it.
+func buildEchoRequest(e icmpEcho) []byte {
+	if len(e.client) == 4 {
+		msg := buildEchoMessage(icmpEchoRequest, e)
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg, 0))
+		return buildIPv4(e.client, e.target, ipProtoICMP, msg)
+	}
+
+	msg := buildEchoMessage(icmpv6EchoRequest, e)
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg, pseudoHeaderSum(e.client, e.target, ipProtoICMPv6, len(msg))))
+	return buildIPv6(e.client, e.target, ipProtoICMPv6, msg)
+}
+
+func TestBuildEchoReply(t *testing.T) {
+	tests := []struct {
+		name string
+		echo icmpEcho
+	}{
+		{"IPv4", icmpEcho{client:echoClient4, target:echoTarget4, id:0x1234, seq:1, data:[]byte("abcdefgh")}},
+		{"IPv4 odd data", icmpEcho{client:echoClient4, target:echoTarget4, id:0xffff, seq:0xfffe, data:[]byte("abc")}},
+		{"IPv4 no data", icmpEcho{client:echoClient4, target:echoTarget4, id:1, seq:2}},
+		{"IPv6", icmpEcho{client:echoClient6, target:echoTarget6, id:0x1234, seq:1, data:[]byte("abcdefgh")}},
+		{"IPv6 odd data", icmpEcho{client:echoClient6, target:echoTarget6, id:0xffff, seq:0xfffe, data:[]byte("abc")}},
+	}
+
+	for _, tt := range tests {
+		e := tt.echo
+		pkt := buildEchoReply(e)
+
+		var msg []byte
+		var sum uint32
+		if len(e.client) == 4 {
+			if len(pkt) != ipv4HeaderSize + icmpHeaderSize + len(e.data) || pkt[0] != 0x45 || pkt[9] != ipProtoICMP ||
+				int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+				t.Errorf("%s: bad IPv4 header % x", tt.name, pkt)
+				continue
+			}
+			if checksum(pkt[:ipv4HeaderSize], 0) != 0 {
+				t.Errorf("%s: bad IPv4 header checksum", tt.name)
+			}
+			if tcpip.Address(pkt[12:16]) != e.target || tcpip.Address(pkt[16:20]) != e.client {
+				t.Errorf("%s: reply from %s to %s", tt.name, net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+			}
+			msg = pkt[ipv4HeaderSize:]
+			if msg[0] != icmpEchoReply {
+				t.Errorf("%s: ICMP type %d, want %d", tt.name, msg[0], icmpEchoReply)
+			}
+		} else {
+			if len(pkt) != ipv6HeaderSize + icmpHeaderSize + len(e.data) || pkt[0] != 0x60 || pkt[6] != ipProtoICMPv6 ||
+				int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt) - ipv6HeaderSize {
+				t.Errorf("%s: bad IPv6 header % x", tt.name, pkt)
+				continue
+			}
+			if tcpip.Address(pkt[8:24]) != e.target || tcpip.Address(pkt[24:40]) != e.client {
+				t.Errorf("%s: reply from %s to %s", tt.name, net.IP(pkt[8:24]), net.IP(pkt[24:40]))
+			}
+			msg = pkt[ipv6HeaderSize:]
+			sum = pseudoHeaderSum(e.target, e.client, ipProtoICMPv6, len(msg))
+			if msg[0] != icmpv6EchoReply {
+				t.Errorf("%s: ICMPv6 type %d, want %d", tt.name, msg[0], icmpv6EchoReply)
+			}
+		}
+
+		if checksum(msg, sum) != 0 {
+			t.Errorf("%s: bad ICMP checksum % x", tt.name, msg)
+		}
+		if msg[1] != 0 || binary.BigEndian.Uint16(msg[4:]) != e.id || binary.BigEndian.Uint16(msg[6:]) != e.seq ||
+			!bytes.Equal(msg[icmpHeaderSize:], e.data) {
+			t.Errorf("%s: reply message % x does not echo the request", tt.name, msg)
+		}
+	}
+}
+
+func TestParseEchoRequest(t *testing.T) {
+	e4 := icmpEcho{client:echoClient4, target:echoTarget4, id:0x1234, seq:7, data:[]byte("ping")}
+	e6 := icmpEcho{client:echoClient6, target:echoTarget6, id:0x1234, seq:7, data:[]byte("ping")}
+
+	fragment := buildEchoRequest(e4)
+	binary.BigEndian.PutUint16(fragment[6:], 0x2000)
+	truncated := buildEchoRequest(e4)
+	truncated = truncated[:len(truncated) - 2]
+	// the link may pad a packet beyond its IP length
+	padded6 := append(buildEchoRequest(e6), 0, 0, 0, 0)
+	reply4 := buildEchoReply(icmpEcho{client:echoTarget4, target:echoClient4, id:1, seq:1})
+	reply6 := buildEchoReply(icmpEcho{client:echoTarget6, target:echoClient6, id:1, seq:1})
+	udp := buildIPv4(echoClient4, echoTarget4, ipProtoUDP, make([]byte, 12))
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		ok   bool
+		want icmpEcho
+	}{
+		{"IPv4 request", buildEchoRequest(e4), true, e4},
+		{"IPv6 request", buildEchoRequest(e6), true, e6},
+		{"IPv6 request with link padding", padded6, true, e6},
+		{"IPv4 fragment", fragment, false, icmpEcho{}},
+		{"IPv4 truncated", truncated, false, icmpEcho{}},
+		{"IPv4 reply", reply4, false, icmpEcho{}},
+		{"IPv6 reply", reply6, false, icmpEcho{}},
+		{"UDP", udp, false, icmpEcho{}},
+		{"too short", []byte{0x45, 0}, false, icmpEcho{}},
+	}
+
+	for _, tt := range tests {
+		e, ok := parseEchoRequest(tt.pkt)
+		if ok != tt.ok {
+			t.Errorf("%s: parsed %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e.client != tt.want.client || e.target != tt.want.target || e.id != tt.want.id || e.seq != tt.want.seq ||
+			!bytes.Equal(e.data, tt.want.data) {
+			t.Errorf("%s: parsed %+v, want %+v", tt.name, e, tt.want)
+		}
+		if !mayBeEchoRequest(tt.pkt) {
+			t.Errorf("%s: not an echo request for mayBeEchoRequest", tt.name)
+		}
+	}
+}
+
+func TestMayBeEchoRequest(t *testing.T) {
+	request4 := buildEchoRequest(icmpEcho{client:echoClient4, target:echoTarget4, id:1, seq:1})
+	request6 := buildEchoRequest(icmpEcho{client:echoClient6, target:echoTarget6, id:1, seq:1})
+
+	tests := []struct {
+		name string
+		hdr  []byte
+		want bool
+	}{
+		{"IPv4 request", request4, true},
+		{"IPv4 header only", request4[:ipv4HeaderSize], true},
+		{"IPv4 reply", buildEchoReply(icmpEcho{client:echoClient4, target:echoTarget4}), false},
+		{"IPv4 UDP", buildIPv4(echoClient4, echoTarget4, ipProtoUDP, make([]byte, 40)), false},
+		{"IPv6 request", request6, true},
+		{"IPv6 header only", request6[:ipv6HeaderSize], true},
+		{"IPv6 reply", buildEchoReply(icmpEcho{client:echoClient6, target:echoTarget6}), false},
+		{"IPv6 TCP", buildIPv6(echoClient6, echoTarget6, ipProtoTCP, make([]byte, 20)), false},
+		{"too short to tell", request6[:8], true},
+	}
+
+	for _, tt := range tests {
+		if got := mayBeEchoRequest(tt.hdr); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
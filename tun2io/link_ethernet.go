@@ -0,0 +1,320 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+const (
+	ethHeaderSize = 14
+	ethTypeIPv4 = 0x0800
+	ethTypeARP = 0x0806
+	ethTypeIPv6 = 0x86dd
+
+	arpSize = 28
+	arpRequest = 1
+	arpReply = 2
+
+	icmpv6NeighborSolicit = 135
+	icmpv6NeighborAdvert = 136
+	ndpHopLimit = 255
+)
+
+var ethBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// EthernetEndpoint is a link endpoint exchanging Ethernet frames with a
+// PacketIO, like the fd of a TAP device. It answers the ARP requests and
+// the IPv6 neighbor solicitations for the addresses of the stack and the
+// ones outside of the subnets of its NIC, so that the clients send all their
+// packets to its MAC, whether for the gateway or for the proxied
+// destinations. The other hosts of the subnets, like the real gateway of a
+// bridge, are left to answer for themselves. Without manager, it answers
+// for every address but the ones of the clients.
+//
+// The MACs of the clients are learned from the frames they send, the packets
+// of the stack to a client whose MAC isn't known are dropped.
+type EthernetEndpoint struct {
+	rawLink
+
+	dispatcher  stack.NetworkDispatcher
+	frames      PacketIO
+	mac         net.HardwareAddr
+	closed      func(error)
+
+	neighborsMu sync.RWMutex
+	neighbors   map[tcpip.Address]net.HardwareAddr
+
+	// claim reports whether the endpoint answers for an address, it is set
+	// by the manager of its NIC
+	claim       func(tcpip.Address) bool
+}
+
+// NewEthernetEndpoint creates and registers an EthernetEndpoint, mtu is the
+// one of the IP packets and mac is the address of the endpoint, a locally
+// administered one is generated if it is nil. closed is called with the
+// error returned by ReadPacket, it may be nil.
+func NewEthernetEndpoint(frames PacketIO, mtu uint32, mac net.HardwareAddr, closed func(error)) tcpip.LinkEndpointID {
+	if mac == nil {
+		mac = make(net.HardwareAddr, 6)
+		rand.Read(mac)
+		mac[0] = mac[0] &^ 0x01 | 0x02
+	}
+
+	e := &EthernetEndpoint{
+		rawLink:rawLink{mtu:mtu},
+		frames:frames,
+		mac:mac,
+		closed:closed,
+		neighbors:make(map[tcpip.Address]net.HardwareAddr, 0),
+	}
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// Attach implements the stack.LinkEndpoint interface, it starts reading
+// frames.
+func (e *EthernetEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	go e.dispatchLoop()
+}
+
+func (e *EthernetEndpoint) dispatchLoop() {
+	buf := &packetBuffer{mtu:ethHeaderSize + int(e.mtu)}
+	for {
+		n, err := e.frames.ReadPacket(buf.next())
+		if err != nil {
+			if e.closed != nil {
+				e.closed(err)
+			}
+			return
+		}
+
+		e.handleFrame(buf.take(n))
+	}
+}
+
+func (e *EthernetEndpoint) handleFrame(frame []byte) {
+	if len(frame) < ethHeaderSize {
+		return
+	}
+
+	// Drop the unicast frames of the other hosts of a bridge
+	dst, src := net.HardwareAddr(frame[0:6]), net.HardwareAddr(frame[6:12])
+	if dst[0] & 0x01 == 0 && !bytes.Equal(dst, e.mac) {
+		return
+	}
+
+	payload := frame[ethHeaderSize:]
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case ethTypeARP:
+		e.handleARP(payload)
+
+	case ethTypeIPv4:
+		if len(payload) >= ipv4HeaderSize {
+			if !isUnspecified(payload[12:16]) {
+				e.learn(tcpip.Address(payload[12:16]), src)
+			}
+			deliverIPPacket(e.dispatcher, e, payload)
+		}
+
+	case ethTypeIPv6:
+		if len(payload) >= ipv6HeaderSize {
+			if !isUnspecified(payload[8:24]) {
+				e.learn(tcpip.Address(payload[8:24]), src)
+			}
+			if !e.handleNDP(payload, src) {
+				deliverIPPacket(e.dispatcher, e, payload)
+			}
+		}
+	}
+}
+
+func isUnspecified(addr []byte) bool {
+	for _, b := range addr {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// learn records mac as the MAC of the client addr.
+func (e *EthernetEndpoint) learn(addr tcpip.Address, mac net.HardwareAddr) {
+	e.neighborsMu.RLock()
+	known := bytes.Equal(e.neighbors[addr], mac)
+	e.neighborsMu.RUnlock()
+	if known {
+		return
+	}
+
+	mac = append(net.HardwareAddr{}, mac...)
+	e.neighborsMu.Lock()
+	e.neighbors[addr] = mac
+	e.neighborsMu.Unlock()
+}
+
+// setClaim makes claim decide the addresses the endpoint answers for, the
+// ones of the clients are never answered for.
+func (e *EthernetEndpoint) setClaim(claim func(tcpip.Address) bool) {
+	e.neighborsMu.Lock()
+	e.claim = claim
+	e.neighborsMu.Unlock()
+}
+
+// claims reports whether the endpoint answers the ARP requests and the
+// neighbor solicitations for addr.
+func (e *EthernetEndpoint) claims(addr tcpip.Address) bool {
+	e.neighborsMu.RLock()
+	_, client := e.neighbors[addr]
+	claim := e.claim
+	e.neighborsMu.RUnlock()
+
+	return !client && (claim == nil || claim(addr))
+}
+
+func (e *EthernetEndpoint) handleARP(arp []byte) {
+	// htype 1 (Ethernet), ptype IPv4, hlen 6 and plen 4
+	if len(arp) < arpSize || binary.BigEndian.Uint16(arp[0:2]) != 1 ||
+		binary.BigEndian.Uint16(arp[2:4]) != ethTypeIPv4 || arp[4] != 6 || arp[5] != 4 {
+		return
+	}
+
+	senderMAC := net.HardwareAddr(arp[8:14])
+	senderIP, targetIP := tcpip.Address(arp[14:18]), tcpip.Address(arp[24:28])
+
+	// Probes have no sender address and announcements ask for the sender
+	// address, answering them would be an address conflict
+	if isUnspecified(arp[14:18]) || senderIP == targetIP {
+		return
+	}
+	e.learn(senderIP, senderMAC)
+
+	if binary.BigEndian.Uint16(arp[6:8]) != arpRequest || !e.claims(targetIP) {
+		return
+	}
+
+	reply := make([]byte, arpSize)
+	copy(reply[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(reply[6:8], arpReply)
+	copy(reply[8:14], e.mac)
+	copy(reply[14:18], targetIP)
+	copy(reply[18:24], senderMAC)
+	copy(reply[24:28], senderIP)
+	e.writeFrame(senderMAC, ethTypeARP, reply)
+}
+
+// handleNDP answers the neighbor solicitation pkt and reports whether pkt was
+// one.
+func (e *EthernetEndpoint) handleNDP(pkt []byte, src net.HardwareAddr) bool {
+	// Solicitations are sent without extension headers
+	msg := pkt[ipv6HeaderSize:]
+	if pkt[6] != ipProtoICMPv6 || len(msg) < 24 || msg[0] != icmpv6NeighborSolicit {
+		return false
+	}
+
+	// A solicitation which was routed is dropped, RFC 4861 7.1.1
+	if pkt[7] != ndpHopLimit {
+		return true
+	}
+
+	client, target := tcpip.Address(pkt[8:24]), tcpip.Address(msg[8:24])
+
+	// Duplicate address detection is sent from the unspecified address
+	if isUnspecified(pkt[8:24]) || !e.claims(target) {
+		return true
+	}
+
+	// Solicited and override flags, the target and its link-layer address
+	advert := make([]byte, 32)
+	advert[0] = icmpv6NeighborAdvert
+	advert[4] = 0x60
+	copy(advert[8:24], target)
+	advert[24] = 2
+	advert[25] = 1
+	copy(advert[26:32], e.mac)
+	binary.BigEndian.PutUint16(advert[2:], checksum(advert, pseudoHeaderSum(target, client, ipProtoICMPv6, len(advert))))
+
+	reply := buildIPv6(target, client, ipProtoICMPv6, advert)
+	reply[7] = ndpHopLimit
+	e.writeFrame(src, ethTypeIPv6, reply)
+	return true
+}
+
+func (e *EthernetEndpoint) writeFrame(dst net.HardwareAddr, ethType uint16, payload []byte) error {
+	frame := make([]byte, ethHeaderSize + len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], e.mac)
+	binary.BigEndian.PutUint16(frame[12:14], ethType)
+	copy(frame[ethHeaderSize:], payload)
+	return e.frames.WritePacket(frame)
+}
+
+// MAC returns the address of the endpoint.
+func (e *EthernetEndpoint) MAC() net.HardwareAddr {
+	return e.mac
+}
+
+// WritePacket implements the stack.LinkEndpoint interface.
+func (e *EthernetEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+	pkt := joinPacket(hdr, payload)
+	if len(pkt) == 0 {
+		return nil
+	}
+
+	ethType, dst := uint16(ethTypeIPv4), tcpip.Address("")
+	if pkt[0] >> 4 == 6 && len(pkt) >= ipv6HeaderSize {
+		ethType, dst = ethTypeIPv6, tcpip.Address(pkt[24:40])
+	} else if len(pkt) >= ipv4HeaderSize {
+		dst = tcpip.Address(pkt[16:20])
+	}
+
+	mac := multicastMAC(dst)
+	if mac == nil {
+		e.neighborsMu.RLock()
+		mac = e.neighbors[dst]
+		e.neighborsMu.RUnlock()
+	}
+
+	// The clients speak first, so the MAC of a destination is only unknown
+	// for a client that didn't send anything yet
+	if mac == nil {
+		return nil
+	}
+	return e.writeFrame(mac, ethType, pkt)
+}
+
+// multicastMAC returns the MAC of the broadcast or multicast address addr,
+// or nil if addr is unicast.
+func multicastMAC(addr tcpip.Address) net.HardwareAddr {
+	switch {
+	case len(addr) == net.IPv4len && addr == "\xff\xff\xff\xff":
+		return ethBroadcast
+	case len(addr) == net.IPv4len && addr[0] & 0xf0 == 0xe0:
+		return net.HardwareAddr{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]}
+	case len(addr) == net.IPv6len && addr[0] == 0xff:
+		return net.HardwareAddr{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+	}
+	return nil
+}
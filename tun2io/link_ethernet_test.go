@@ -0,0 +1,207 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+// discardDispatcher drops the packets delivered by a link endpoint.
+type discardDispatcher struct{}
+
+func (d discardDispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+}
+
+// newTestEthernet returns an EthernetEndpoint on the subnet 192.168.4.0/24
+// whose stack has the address 192.168.4.1, and the frames it writes.
+func newTestEthernet() (*EthernetEndpoint, *[][]byte) {
+	written := &[][]byte{}
+	frames := &PacketFuncs{
+		Read:func(buf []byte) (int, error) { select {} },
+		Write:func(frame []byte) error {
+			*written = append(*written, frame)
+			return nil
+		},
+	}
+
+	e := &EthernetEndpoint{
+		rawLink:rawLink{mtu:1500},
+		dispatcher:discardDispatcher{},
+		frames:frames,
+		mac:net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		neighbors:make(map[tcpip.Address]net.HardwareAddr, 0),
+	}
+
+	_, subnet, _ := net.ParseCIDR("192.168.4.0/24")
+	e.setClaim(func(addr tcpip.Address) bool {
+		ip := net.IP(addr)
+		return ip.Equal(net.ParseIP("192.168.4.1")) || !subnet.Contains(ip)
+	})
+	return e, written
+}
+
+func arpRequestFrame(senderMAC net.HardwareAddr, sender, target string) []byte {
+	frame := make([]byte, ethHeaderSize + arpSize)
+	copy(frame[0:6], ethBroadcast)
+	copy(frame[6:12], senderMAC)
+	binary.BigEndian.PutUint16(frame[12:], ethTypeARP)
+
+	arp := frame[ethHeaderSize:]
+	binary.BigEndian.PutUint16(arp[0:], 1)
+	binary.BigEndian.PutUint16(arp[2:], ethTypeIPv4)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], arpRequest)
+	copy(arp[8:14], senderMAC)
+	copy(arp[14:18], net.ParseIP(sender).To4())
+	copy(arp[24:28], net.ParseIP(target).To4())
+	return frame
+}
+
+func TestEthernetEndpointARP(t *testing.T) {
+	client := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	tests := []struct {
+		target string
+		answer bool
+	}{
+		{"192.168.4.1", true},
+		{"203.0.113.1", true},
+
+		// the real gateway and the silent hosts of the subnet
+		{"192.168.4.254", false},
+		{"192.168.4.3", false},
+	}
+
+	for _, tt := range tests {
+		e, written := newTestEthernet()
+		e.handleFrame(arpRequestFrame(client, "192.168.4.2", tt.target))
+
+		if !tt.answer {
+			if len(*written) != 0 {
+				t.Errorf("ARP request for %s answered", tt.target)
+			}
+			continue
+		}
+		if len(*written) != 1 {
+			t.Errorf("ARP request for %s not answered", tt.target)
+			continue
+		}
+
+		reply := (*written)[0]
+		arp := reply[ethHeaderSize:]
+		if !bytes.Equal(reply[0:6], client) || binary.BigEndian.Uint16(arp[6:]) != arpReply ||
+			!bytes.Equal(arp[8:14], e.mac) || !net.IP(arp[14:18]).Equal(net.ParseIP(tt.target)) {
+			t.Errorf("Bad ARP reply for %s: % x", tt.target, reply)
+		}
+	}
+}
+
+func neighborSolicitFrame(senderMAC net.HardwareAddr, sender, target string, hopLimit byte) []byte {
+	ns := make([]byte, 24)
+	ns[0] = icmpv6NeighborSolicit
+	copy(ns[8:24], net.ParseIP(target))
+	pkt := buildIPv6(tcpip.Address(net.ParseIP(sender)), tcpip.Address(net.ParseIP(target)), ipProtoICMPv6, ns)
+	pkt[7] = hopLimit
+
+	frame := make([]byte, ethHeaderSize + len(pkt))
+	copy(frame[0:6], net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 0x01})
+	copy(frame[6:12], senderMAC)
+	binary.BigEndian.PutUint16(frame[12:], ethTypeIPv6)
+	copy(frame[ethHeaderSize:], pkt)
+	return frame
+}
+
+func TestEthernetEndpointNeighborSolicit(t *testing.T) {
+	client := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	tests := []struct {
+		hopLimit byte
+		answer   bool
+	}{
+		{255, true},
+
+		// routed from another link
+		{64, false},
+		{254, false},
+	}
+
+	for _, tt := range tests {
+		e, written := newTestEthernet()
+		e.handleFrame(neighborSolicitFrame(client, "fd00::2", "2001:db8::1", tt.hopLimit))
+
+		if !tt.answer {
+			if len(*written) != 0 {
+				t.Errorf("Solicitation with hop limit %d answered", tt.hopLimit)
+			}
+			continue
+		}
+		if len(*written) != 1 {
+			t.Errorf("Solicitation with hop limit %d not answered", tt.hopLimit)
+			continue
+		}
+
+		reply := (*written)[0]
+		advert := reply[ethHeaderSize + ipv6HeaderSize:]
+		if !bytes.Equal(reply[0:6], client) || advert[0] != icmpv6NeighborAdvert ||
+			!net.IP(advert[8:24]).Equal(net.ParseIP("2001:db8::1")) || !bytes.Equal(advert[26:32], e.mac) {
+			t.Errorf("Bad neighbor advertisement: % x", reply)
+		}
+	}
+}
+
+func TestEthernetEndpointWritePacket(t *testing.T) {
+	e, written := newTestEthernet()
+	client, server := net.ParseIP("192.168.4.2"), net.ParseIP("203.0.113.1")
+	clientMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+
+	write := func(pkt []byte) {
+		hdr := buffer.NewPrependable(len(pkt))
+		copy(hdr.Prepend(len(pkt)), pkt)
+		if err := e.WritePacket(&stack.Route{}, &hdr, nil, header.IPv4ProtocolNumber); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not sent to a guessed MAC before the client spoke
+	write(buildTestUDP(server, client, 53, 40000, []byte("reply")))
+	if len(*written) != 0 {
+		t.Fatalf("Packet to an unknown client sent to % x", (*written)[0][0:6])
+	}
+
+	pkt := buildTestUDP(client, server, 40000, 53, []byte("query"))
+	frame := make([]byte, ethHeaderSize + len(pkt))
+	copy(frame[0:6], e.mac)
+	copy(frame[6:12], clientMAC)
+	binary.BigEndian.PutUint16(frame[12:], ethTypeIPv4)
+	copy(frame[ethHeaderSize:], pkt)
+	e.handleFrame(frame)
+
+	// Another client speaking last doesn't get the packets of the first
+	e.handleFrame(arpRequestFrame(net.HardwareAddr{0x02, 0, 0, 0, 0, 3}, "192.168.4.3", "203.0.113.1"))
+	*written = nil
+
+	write(buildTestUDP(server, client, 53, 40000, []byte("reply")))
+	if len(*written) != 1 || !bytes.Equal((*written)[0][0:6], clientMAC) {
+		t.Fatalf("Packet to the client not sent to its MAC %s", clientMAC)
+	}
+}
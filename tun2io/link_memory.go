@@ -0,0 +1,97 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"sync/atomic"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+// MemoryEndpoint is a link endpoint without device, packets are injected into
+// the stack with Inject and the packets written by the stack are sent to C.
+type MemoryEndpoint struct {
+	dropped    uint64
+	rawLink
+
+	dispatcher stack.NetworkDispatcher
+
+	// C receives the IP packets written by the stack, they are dropped if it
+	// is full
+	C          chan []byte
+}
+
+// NewMemoryEndpoint creates and registers a MemoryEndpoint, size is the
+// capacity of C.
+func NewMemoryEndpoint(mtu uint32, size int) (tcpip.LinkEndpointID, *MemoryEndpoint) {
+	e := &MemoryEndpoint{rawLink:rawLink{mtu:mtu}, C:make(chan []byte, size)}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// Inject delivers an IP packet to the stack as if it was read from a device.
+func (e *MemoryEndpoint) Inject(pkt []byte) {
+	if e.dispatcher != nil {
+		deliverIPPacket(e.dispatcher, e, pkt)
+	}
+}
+
+// Dropped returns the number of packets dropped because C was full.
+func (e *MemoryEndpoint) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Attach implements the stack.LinkEndpoint interface.
+func (e *MemoryEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+}
+
+// WritePacket implements the stack.LinkEndpoint interface.
+func (e *MemoryEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+	select {
+	case e.C <- joinPacket(hdr, payload):
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+	return nil
+}
+
+// deliverIPPacket passes a raw IP packet read from linkEP to d, with the
+// network protocol of its version.
+func deliverIPPacket(d stack.NetworkDispatcher, linkEP stack.LinkEndpoint, pkt []byte) {
+	if len(pkt) == 0 {
+		return
+	}
+
+	protocol := header.IPv4ProtocolNumber
+	if pkt[0] >> 4 == 6 {
+		protocol = header.IPv6ProtocolNumber
+	}
+
+	vv := buffer.NewVectorisedView(len(pkt), []buffer.View{buffer.View(pkt)})
+	d.DeliverNetworkPacket(linkEP, protocol, &vv)
+}
+
+// joinPacket returns the packet written by the stack as one slice.
+func joinPacket(hdr *buffer.Prependable, payload buffer.View) []byte {
+	used := hdr.UsedBytes()
+	pkt := make([]byte, 0, len(used) + len(payload))
+	pkt = append(pkt, used...)
+	return append(pkt, payload...)
+}
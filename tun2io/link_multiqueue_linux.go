@@ -0,0 +1,95 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"hash/fnv"
+	"log"
+	"syscall"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+// MultiQueueEndpoint is a link endpoint on the queue fds of a multi-queue
+// tun, each queue is read by its own goroutine.
+//
+// The packets of a flow are written on the queue given by the hash of its
+// addresses and ports, the same in both directions. The kernel steers the
+// packets it sends to the queue a flow was last written on, so that each
+// connection stays on one queue.
+type MultiQueueEndpoint struct {
+	rawLink
+
+	dispatcher stack.NetworkDispatcher
+	fds        []int
+}
+
+// NewMultiQueueEndpoint creates and registers a MultiQueueEndpoint.
+func NewMultiQueueEndpoint(fds []int, mtu uint32) tcpip.LinkEndpointID {
+	e := &MultiQueueEndpoint{rawLink:rawLink{mtu:mtu}, fds:fds}
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// Attach implements the stack.LinkEndpoint interface, it starts reading
+// the queues.
+func (e *MultiQueueEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	for _, fd := range e.fds {
+		go e.dispatchLoop(fd)
+	}
+}
+
+func (e *MultiQueueEndpoint) dispatchLoop(fd int) {
+	err := readPackets(e.dispatcher, e, &fdPacketIO{fd:fd}, e.mtu)
+	log.Printf("Queue %d of the tun stopped: %v\n", fd, err)
+}
+
+// WritePacket implements the stack.LinkEndpoint interface.
+func (e *MultiQueueEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+	pkt := joinPacket(hdr, payload)
+	fd := e.fds[flowHash(pkt) % uint32(len(e.fds))]
+
+	// A write on a tun fd sends the whole packet or fails
+	_, err := syscall.Write(fd, pkt)
+	return err
+}
+
+// flowHash hashes the protocol, the addresses and the ports of pkt, the two
+// directions of a flow have the same hash.
+func flowHash(pkt []byte) uint32 {
+	p, ok := parseCapturePacket(pkt)
+	if !ok {
+		return 0
+	}
+
+	a := append(append([]byte{}, p.src...), byte(p.srcPort >> 8), byte(p.srcPort))
+	b := append(append([]byte{}, p.dst...), byte(p.dstPort >> 8), byte(p.dstPort))
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte{p.proto})
+	h.Write(a)
+	h.Write(b)
+	return h.Sum32()
+}
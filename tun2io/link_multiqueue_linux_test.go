@@ -0,0 +1,202 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/header"
+	"github.com/FTwOoO/netstack/tcpip/link/fdbased"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+const (
+	benchMTU = 1500
+	benchFlows = 64
+	benchPayloadSize = 1024
+)
+
+func TestFlowHashSymmetric(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       string
+	}{
+		{"IPv4", "192.168.4.2", "203.0.113.1"},
+		{"IPv6", "fd00::2", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.ParseIP(tt.a), net.ParseIP(tt.b)
+			out := buildTestTCP(a, b, 40000, 443, 1, 0, tcpFlagSYN, nil)
+			in := buildTestTCP(b, a, 443, 40000, 1, 2, tcpFlagSYN | testTCPFlagACK, nil)
+			if flowHash(out) != flowHash(in) {
+				t.Errorf("TCP hashes %08x and %08x differ", flowHash(out), flowHash(in))
+			}
+
+			out = buildTestUDP(a, b, 40000, 53, []byte("query"))
+			in = buildTestUDP(b, a, 53, 40000, []byte("a longer reply"))
+			if flowHash(out) != flowHash(in) {
+				t.Errorf("UDP hashes %08x and %08x differ", flowHash(out), flowHash(in))
+			}
+		})
+	}
+
+	if h := flowHash([]byte{0x00, 0x01}); h != 0 {
+		t.Errorf("Hash %08x of a packet that isn't IP, want 0", h)
+	}
+}
+
+// benchPackets returns UDP packets of benchFlows flows.
+func benchPackets() [][]byte {
+	client, server := net.ParseIP("192.168.4.2"), net.ParseIP("203.0.113.1")
+	payload := make([]byte, benchPayloadSize)
+	pkts := make([][]byte, benchFlows)
+	for i := range pkts {
+		pkts[i] = buildTestUDP(client, server, uint16(40000 + i), 443, payload)
+	}
+	return pkts
+}
+
+// benchSocketpairs returns n pairs of connected packet sockets, standing for
+// the queues of a tun and the kernel side of them.
+func benchSocketpairs(b *testing.B, n int) (ends, peers []int) {
+	for i := 0; i < n; i++ {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ends = append(ends, fds[0])
+		peers = append(peers, fds[1])
+	}
+	return ends, peers
+}
+
+// benchDispatcher counts the packets delivered by a link endpoint and closes
+// done once it has want of them.
+type benchDispatcher struct {
+	n    int64
+	want int64
+	done chan struct{}
+}
+
+func (d *benchDispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	if atomic.AddInt64(&d.n, 1) == d.want {
+		close(d.done)
+	}
+}
+
+// benchLinkRead measures the packets read by the endpoint of newEndpoint on
+// queues fds, the kernel side writing the flows on the queue of their hash.
+func benchLinkRead(b *testing.B, queues int, newEndpoint func(fds []int) stack.LinkEndpoint) {
+	ends, peers := benchSocketpairs(b, queues)
+	pkts := benchPackets()
+
+	d := &benchDispatcher{want:int64(b.N), done:make(chan struct{})}
+	newEndpoint(ends).Attach(d)
+
+	b.SetBytes(int64(len(pkts[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for q := range peers {
+		go func(q int) {
+			for i := q; i < b.N; i += queues {
+				pkt := pkts[i % len(pkts)]
+				syscall.Write(peers[q], pkt)
+			}
+		}(q)
+	}
+	<-d.done
+	b.StopTimer()
+
+	// The dispatch loops can't be stopped, their fds are left open for them
+	// to block on
+}
+
+// benchLinkWrite measures the packets written by the endpoint of newEndpoint
+// on queues fds, drained by the kernel side.
+func benchLinkWrite(b *testing.B, queues int, newEndpoint func(fds []int) stack.LinkEndpoint) {
+	ends, peers := benchSocketpairs(b, queues)
+	pkts := benchPackets()
+	e := newEndpoint(ends)
+
+	for _, fd := range peers {
+		go func(fd int) {
+			buf := make([]byte, benchMTU)
+			for {
+				// the end of the fd is read once ends are closed
+				if n, err := syscall.Read(fd, buf); n <= 0 || err != nil {
+					syscall.Close(fd)
+					return
+				}
+			}
+		}(fd)
+	}
+
+	b.SetBytes(int64(len(pkts[0])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := pkts[i % len(pkts)]
+		hdr := buffer.NewPrependable(len(pkt))
+		copy(hdr.Prepend(len(pkt)), pkt)
+		if err := e.WritePacket(&stack.Route{}, &hdr, nil, header.IPv4ProtocolNumber); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	closeFds(ends)
+}
+
+func newFdbasedBench(fds []int) stack.LinkEndpoint {
+	return stack.FindLinkEndpoint(fdbased.New(fds[0], benchMTU, nil))
+}
+
+func newMultiQueueBench(fds []int) stack.LinkEndpoint {
+	return stack.FindLinkEndpoint(NewMultiQueueEndpoint(fds, benchMTU))
+}
+
+func BenchmarkLinkRead(b *testing.B) {
+	b.Run("fdbased", func(b *testing.B) {
+		benchLinkRead(b, 1, newFdbasedBench)
+	})
+	for _, queues := range []int{1, 2, 4} {
+		b.Run("multiqueue-" + strconv.Itoa(queues), func(b *testing.B) {
+			benchLinkRead(b, queues, newMultiQueueBench)
+		})
+	}
+}
+
+func BenchmarkLinkWrite(b *testing.B) {
+	b.Run("fdbased", func(b *testing.B) {
+		benchLinkWrite(b, 1, newFdbasedBench)
+	})
+	for _, queues := range []int{1, 2, 4} {
+		b.Run("multiqueue-" + strconv.Itoa(queues), func(b *testing.B) {
+			benchLinkWrite(b, queues, newMultiQueueBench)
+		})
+	}
+}
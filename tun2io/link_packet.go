@@ -0,0 +1,176 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"syscall"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+// PacketIO is a source and a sink of raw IP packets, like a userspace VPN.
+type PacketIO interface {
+	// ReadPacket blocks until a packet is copied into buf and returns its
+	// length, an error stops the reading
+	ReadPacket(buf []byte) (int, error)
+
+	// WritePacket sends a packet of the stack, pkt is not reused by the
+	// stack and can be kept. It may be called from several goroutines.
+	WritePacket(pkt []byte) error
+}
+
+// PacketFuncs is a PacketIO calling its functions.
+type PacketFuncs struct {
+	Read  func(buf []byte) (int, error)
+	Write func(pkt []byte) error
+}
+
+// ReadPacket implements the PacketIO interface.
+func (f *PacketFuncs) ReadPacket(buf []byte) (int, error) {
+	return f.Read(buf)
+}
+
+// WritePacket implements the PacketIO interface.
+func (f *PacketFuncs) WritePacket(pkt []byte) error {
+	return f.Write(pkt)
+}
+
+// fdPacketIO reads and writes one packet per system call on a device fd.
+type fdPacketIO struct {
+	fd int
+}
+
+// ReadPacket implements the PacketIO interface.
+func (f *fdPacketIO) ReadPacket(buf []byte) (int, error) {
+	for {
+		n, err := syscall.Read(f.fd, buf)
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
+
+// WritePacket implements the PacketIO interface.
+func (f *fdPacketIO) WritePacket(pkt []byte) error {
+	_, err := syscall.Write(f.fd, pkt)
+	return err
+}
+
+// rawLink has the methods shared by the link endpoints of raw IP packets,
+// without link header nor address.
+type rawLink struct {
+	mtu uint32
+}
+
+// MTU implements the stack.LinkEndpoint interface.
+func (l *rawLink) MTU() uint32 {
+	return l.mtu
+}
+
+// Capabilities implements the stack.LinkEndpoint interface.
+func (l *rawLink) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength implements the stack.LinkEndpoint interface.
+func (l *rawLink) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress implements the stack.LinkEndpoint interface.
+func (l *rawLink) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+// packetChunkSize is the number of packets of MTU bytes a packetBuffer
+// allocates at once
+const packetChunkSize = 16
+
+// packetBuffer cuts the buffers of the packets read from a device out of
+// larger chunks. The stack keeps the packets it is given, so a buffer is
+// never reused, the chunk is freed with the last of its packets.
+type packetBuffer struct {
+	chunk []byte
+	mtu   int
+}
+
+// next returns the buffer of the next packet, of MTU bytes.
+func (b *packetBuffer) next() []byte {
+	if len(b.chunk) < b.mtu {
+		b.chunk = make([]byte, b.mtu * packetChunkSize)
+	}
+	return b.chunk[:b.mtu]
+}
+
+// take returns the first n bytes of the buffer given by next, which are not
+// handed out again.
+func (b *packetBuffer) take(n int) []byte {
+	pkt := b.chunk[:n:n]
+	b.chunk = b.chunk[n:]
+	return pkt
+}
+
+// readPackets delivers the packets of packets to the dispatcher d as read
+// from linkEP, until ReadPacket fails with the error returned.
+func readPackets(d stack.NetworkDispatcher, linkEP stack.LinkEndpoint, packets PacketIO, mtu uint32) error {
+	buf := &packetBuffer{mtu:int(mtu)}
+	for {
+		n, err := packets.ReadPacket(buf.next())
+		if err != nil {
+			return err
+		}
+		deliverIPPacket(d, linkEP, buf.take(n))
+	}
+}
+
+// PacketEndpoint is a link endpoint exchanging the packets of the stack with
+// a PacketIO.
+type PacketEndpoint struct {
+	rawLink
+
+	dispatcher stack.NetworkDispatcher
+	packets    PacketIO
+	closed     func(error)
+}
+
+// NewPacketEndpoint creates and registers a PacketEndpoint, closed is called
+// with the error returned by ReadPacket, it may be nil.
+func NewPacketEndpoint(packets PacketIO, mtu uint32, closed func(error)) tcpip.LinkEndpointID {
+	e := &PacketEndpoint{rawLink:rawLink{mtu:mtu}, packets:packets, closed:closed}
+	return stack.RegisterLinkEndpoint(e)
+}
+
+// Attach implements the stack.LinkEndpoint interface, it starts reading
+// packets.
+func (e *PacketEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	go e.dispatchLoop()
+}
+
+func (e *PacketEndpoint) dispatchLoop() {
+	err := readPackets(e.dispatcher, e, e.packets, e.mtu)
+	if e.closed != nil {
+		e.closed(err)
+	}
+}
+
+// WritePacket implements the stack.LinkEndpoint interface.
+func (e *PacketEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) error {
+	return e.packets.WritePacket(joinPacket(hdr, payload))
+}
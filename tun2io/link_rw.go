@@ -0,0 +1,52 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"io"
+	"sync"
+	"github.com/FTwOoO/netstack/tcpip"
+)
+
+// ReadWriterEndpoint is the PacketIO of a PacketEndpoint exchanging raw IP
+// packets with an io.ReadWriter, like a tun fd does: each Read returns one
+// packet and each packet is written with one Write.
+type ReadWriterEndpoint struct {
+	rw      io.ReadWriter
+	writeMu sync.Mutex
+}
+
+// NewReadWriterEndpoint creates and registers a PacketEndpoint on rw, closed
+// is called with the error that stopped the reading, it may be nil.
+func NewReadWriterEndpoint(rw io.ReadWriter, mtu uint32, closed func(error)) tcpip.LinkEndpointID {
+	return NewPacketEndpoint(&ReadWriterEndpoint{rw:rw}, mtu, closed)
+}
+
+// ReadPacket implements the PacketIO interface.
+func (e *ReadWriterEndpoint) ReadPacket(buf []byte) (int, error) {
+	return e.rw.Read(buf)
+}
+
+// WritePacket implements the PacketIO interface.
+func (e *ReadWriterEndpoint) WritePacket(pkt []byte) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	_, err := e.rw.Write(pkt)
+	return err
+}
@@ -0,0 +1,69 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"net"
+	"testing"
+)
+
+// newPipeClient starts a manager on a ReadWriterEndpoint over one end of a
+// net.Pipe and plays its client on the other end.
+func newPipeClient(t *testing.T, echo string) (*testClient, *Tun2ioManager, net.Conn) {
+	stackSide, clientSide := net.Pipe()
+	linkID, err := CreateReadWriterLinkEndpoint(stackSide, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, subnet, _ := net.ParseCIDR("192.168.4.1/24")
+	m, err := Tun2IO(ip, subnet, linkID, false, &redirectDialer{addr:echo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := make(chan []byte, 64)
+	go func() {
+		for {
+			buf := make([]byte, 1500)
+			n, err := clientSide.Read(buf)
+			if err != nil {
+				return
+			}
+			recv <- buf[:n]
+		}
+	}()
+
+	send := func(pkt []byte) {
+		if _, err := clientSide.Write(pkt); err != nil {
+			t.Errorf("Write to the pipe failed: %s", err)
+		}
+	}
+	return &testClient{t:t, send:send, recv:recv}, m, clientSide
+}
+
+func TestReadWriterEndpointTCPEcho(t *testing.T) {
+	l := startTCPEcho(t)
+	defer l.Close()
+
+	c, m, conn := newPipeClient(t, l.Addr().String())
+	defer conn.Close()
+	defer m.Close()
+
+	c.tcpEcho(net.ParseIP("192.168.4.2"), net.ParseIP("203.0.113.1"))
+}
@@ -28,36 +28,82 @@ import (
 	"github.com/FTwOoO/netstack/tcpip/buffer"
 	"golang.org/x/net/proxy"
 	"github.com/athom/goset"
+	"github.com/miekg/dns"
 )
 
 type Tun2ioManager struct {
 	stack                  tcpip.Stack
 	nicid                  tcpip.NICID
-	nic                    *stack.NIC
+	config                 Config
 
-	defaultDialer          proxy.Dialer
+	// nics are the NICs served, nicid being the first one
+	nicsMu                 sync.RWMutex
+	nics                   []*managedNIC
+
+	router                 *Router
+	domains                *DomainTable
 
 	tunnelsMu              sync.Mutex
 	tunnels                map[TransportID]*Tunnel
 	tcpListeners           map[TransportID]*TcpListener
 
 	tcpListener2TcpTunnels map[TransportID][]TransportID
-	subnets                []tcpip.Subnet
+
+	dnsCache               *DnsCache
+	dnsHosts               *DnsHosts
+	dnsFilter              *DnsFilter
+	dnsHandler             dns.Handler
+	dnsHijack              bool
+	dnsServers             map[tcpip.Address]*DnsServer
+
+	sniffPorts             map[uint16]bool
+	dialByName             bool
+	classify               bool
+	quicPolicy             QUICPolicy
+	icmpPolicy             ICMPPolicy
+	icmpForwarder          *icmpForwarder
+	tcpConfig              TCPConfig
+
+	linkEP                 stack.LinkEndpoint
+	captureEP              *CaptureEndpoint
+
+	flowSinksMu            sync.RWMutex
+	flowSinks              []FlowSink
 }
 
 func NewTun2ioManager(s tcpip.Stack, nicid tcpip.NICID, defaultDialer proxy.Dialer) (*Tun2ioManager, error) {
+	return newTun2ioManager(s, Config{NICID:nicid, Dialer:defaultDialer}.withDefaults())
+}
+
+// newTun2ioManager creates the manager of the NIC of config on s, config has
+// its defaults.
+func newTun2ioManager(s tcpip.Stack, config Config) (*Tun2ioManager, error) {
+	tcpConfig, err := config.TCP.validate()
+	if err != nil {
+		return nil, err
+	}
 
 	m := &Tun2ioManager{
 		stack:s,
+		config:config,
 		tunnels: make(map[TransportID]*Tunnel, 0),
 		tcpListeners: make(map[TransportID]*TcpListener, 0),
 		tcpListener2TcpTunnels: make(map[TransportID][]TransportID, 0),
-		defaultDialer:defaultDialer,
-		nicid: nicid,
+		router:NewRouter(config.Dialer),
+		domains:NewDomainTable(),
+		sniffPorts:make(map[uint16]bool, 0),
+		dnsServers:make(map[tcpip.Address]*DnsServer, 0),
+		icmpForwarder:newICMPForwarder(config.ICMPFlowTimeout),
+		tcpConfig:tcpConfig,
+		nicid:config.NICID,
 	}
 
-	m.subnets = s.NICSubnets()[nicid]
-	m.nic = m.stack.(*stack.Stack).GetNic(m.nicid)
+	m.nics = []*managedNIC{m.newManagedNIC(config.NICID, nil)}
+	for _, a := range config.Addrs {
+		if addr, subnet, _, err := ipNetToSubnet(a); err == nil {
+			m.nics[0].addrs[addr] = subnet
+		}
+	}
 
 	s.(*stack.Stack).SetTransportProtocolHandler(header.TCPProtocolNumber, m.tcpHandler)
 	s.(*stack.Stack).SetTransportProtocolHandler(header.UDPProtocolNumber, m.udpHandler)
@@ -74,6 +120,371 @@ func (m *Tun2ioManager) GetNICID() tcpip.NICID {
 	return m.nicid
 }
 
+// GetDnsCache returns the cache in front of the local DNS server, or nil if
+// the DNS endpoint was not created.
+func (m *Tun2ioManager) GetDnsCache() *DnsCache {
+	return m.dnsCache
+}
+
+// GetDnsHosts returns the static records answered by the local DNS server,
+// or nil if the DNS endpoint was not created.
+func (m *Tun2ioManager) GetDnsHosts() *DnsHosts {
+	return m.dnsHosts
+}
+
+// GetDnsFilter returns the blocklist filter of the local DNS server, or nil
+// if the DNS endpoint was not created.
+func (m *Tun2ioManager) GetDnsFilter() *DnsFilter {
+	return m.dnsFilter
+}
+
+// SetDnsRouter makes the local DNS server resolve the names without local
+// records through r, queries r does not route go to the default relay.
+func (m *Tun2ioManager) SetDnsRouter(r *DnsRouter) error {
+	if m.dnsHosts == nil {
+		return errNoDnsHandler
+	}
+
+	if r.Fallback == nil {
+		r.Fallback = m.dnsCache
+	}
+	m.dnsHosts.SetNext(r)
+	return nil
+}
+
+// SetDNSHijack makes all UDP and TCP flows to port 53, whatever their
+// destination, be answered by the local DNS handler instead of being tunneled.
+func (m *Tun2ioManager) SetDNSHijack(enable bool) error {
+	if enable && m.dnsHandler == nil {
+		return errNoDnsHandler
+	}
+
+	m.tunnelsMu.Lock()
+	m.dnsHijack = enable
+	m.tunnelsMu.Unlock()
+	return nil
+}
+
+// GetRouter returns the router choosing the dialer of each tunnel.
+func (m *Tun2ioManager) GetRouter() *Router {
+	return m.router
+}
+
+// GetDomainTable returns the addresses learned from the answers of the local
+// DNS server.
+func (m *Tun2ioManager) GetDomainTable() *DomainTable {
+	return m.domains
+}
+
+// SetSniffing makes TCP tunnels to ports read the first bytes of the client
+// before dialing, to learn the target domain from the TLS server name or the
+// HTTP Host header. UDP tunnels to ports learn it from the server name in
+// the QUIC Initial packet. If
+// dialByName is true, tunnels whose domain is known dial it instead of the
+// target address, letting the proxy resolve it.
+func (m *Tun2ioManager) SetSniffing(ports []uint16, dialByName bool) {
+	m.tunnelsMu.Lock()
+	defer m.tunnelsMu.Unlock()
+
+	m.sniffPorts = make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		m.sniffPorts[p] = true
+	}
+	m.dialByName = dialByName
+}
+
+// SetClassifying makes every tunnel read the first bytes of the client before
+// dialing to label it with its application protocol, whatever its port, so
+// that route rules can match on Protocols. TCP clients that wait for the
+// server to speak first are delayed by up to Config.SniffTimeout, they are
+// labelled later from the first bytes of the server, too late for routing.
+func (m *Tun2ioManager) SetClassifying(enabled bool) {
+	m.tunnelsMu.Lock()
+	m.classify = enabled
+	m.tunnelsMu.Unlock()
+}
+
+// SetQUICPolicy sets how new flows starting with a QUIC Initial packet are
+// handled. Dropping or rejecting them makes browsers fall back to TLS over
+// TCP, which the proxy can carry.
+func (m *Tun2ioManager) SetQUICPolicy(p QUICPolicy) {
+	m.tunnelsMu.Lock()
+	m.quicPolicy = p
+	m.tunnelsMu.Unlock()
+}
+
+// SetICMPPolicy sets how the echo requests of the clients are handled, the
+// stack has no ICMP transport so they time out by default. The requests to
+// the addresses of the NICs are always answered locally when handled.
+// ICMPForward needs SetICMPMark or SetICMPDevice, the requests are dropped
+// without them.
+func (m *Tun2ioManager) SetICMPPolicy(p ICMPPolicy) {
+	m.tunnelsMu.Lock()
+	m.icmpPolicy = p
+	m.tunnelsMu.Unlock()
+}
+
+// SetICMPMark sets the socket mark of the forwarded echo requests, like the
+// one of the dialers in policy routing.
+func (m *Tun2ioManager) SetICMPMark(mark int) {
+	m.icmpForwarder.setMark(mark)
+}
+
+// SetICMPDevice binds the sockets of the forwarded echo requests to the
+// device name, like the one of the default route without the tun. It needs
+// CAP_NET_RAW before Linux 5.7.
+func (m *Tun2ioManager) SetICMPDevice(name string) {
+	m.icmpForwarder.setDevice(name)
+}
+
+// SetTCPConfig tunes the TCP endpoints created from now on, the stack-wide
+// options like SACK apply to the existing ones as well.
+func (m *Tun2ioManager) SetTCPConfig(c TCPConfig) error {
+	c, err := c.validate()
+	if err != nil {
+		return err
+	}
+	if err := c.applyStack(m.stack); err != nil {
+		return err
+	}
+
+	m.tunnelsMu.Lock()
+	m.tcpConfig = c
+	m.tunnelsMu.Unlock()
+
+	m.nicsMu.RLock()
+	for _, n := range m.nics {
+		if ep, ok := n.linkEP.(*CaptureEndpoint); ok {
+			ep.setMSSClamp(uint16(c.MSS))
+		}
+	}
+	m.nicsMu.RUnlock()
+	return nil
+}
+
+// GetTCPConfig returns the TCP config in use.
+func (m *Tun2ioManager) GetTCPConfig() TCPConfig {
+	m.tunnelsMu.Lock()
+	defer m.tunnelsMu.Unlock()
+	return m.tcpConfig
+}
+
+// AddFlowSink makes the manager write a FlowRecord to s when a tunnel is
+// opened, closed or fails to open.
+func (m *Tun2ioManager) AddFlowSink(s FlowSink) {
+	m.flowSinksMu.Lock()
+	m.flowSinks = append(m.flowSinks, s)
+	m.flowSinksMu.Unlock()
+}
+
+// RemoveFlowSink stops writing flow records to s, it is not closed.
+func (m *Tun2ioManager) RemoveFlowSink(s FlowSink) {
+	m.flowSinksMu.Lock()
+	defer m.flowSinksMu.Unlock()
+
+	for i, sink := range m.flowSinks {
+		if sink == s {
+			m.flowSinks = append(m.flowSinks[:i:i], m.flowSinks[i + 1:]...)
+			break
+		}
+	}
+}
+
+func (m *Tun2ioManager) logFlow(t *Tunnel, event string, reason error) {
+	m.flowSinksMu.RLock()
+	defer m.flowSinksMu.RUnlock()
+
+	if len(m.flowSinks) == 0 {
+		return
+	}
+
+	r := newFlowRecord(t, event, reason)
+	for _, s := range m.flowSinks {
+		if err := s.WriteFlow(r); err != nil {
+			log.Printf("Write flow record failed: %s\n", err)
+		}
+	}
+}
+
+// StartCapture writes the packets of the link endpoint as described by config,
+// replacing the running capture.
+func (m *Tun2ioManager) StartCapture(config CaptureConfig) error {
+	if m.captureEP == nil {
+		return errNoCaptureEndpoint
+	}
+
+	c, err := NewCapture(config)
+	if err != nil {
+		return err
+	}
+
+	if old := m.captureEP.SetCapture(c); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// StopCapture stops the running capture, if any.
+func (m *Tun2ioManager) StopCapture() error {
+	if m.captureEP == nil {
+		return errNoCaptureEndpoint
+	}
+
+	if old := m.captureEP.SetCapture(nil); old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Close stops the DNS endpoints, the tunnels and the listeners of the
+// manager, the reloading of the DNS records and the capture.
+func (m *Tun2ioManager) Close() error {
+	m.nicsMu.Lock()
+	for addr, d := range m.dnsServers {
+		d.Close(errDeviceClosed)
+		delete(m.dnsServers, addr)
+	}
+	m.nicsMu.Unlock()
+
+	if m.dnsHosts != nil {
+		m.dnsHosts.Close()
+	}
+
+	m.tunnelsMu.Lock()
+	var tunnels []*Tunnel
+	for _, t := range m.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	for id, l := range m.tcpListeners {
+		l.Close()
+		delete(m.tcpListeners, id)
+	}
+	m.tunnelsMu.Unlock()
+
+	// Closed tunnels remove themselves from the manager
+	for _, t := range tunnels {
+		t.Close(errDeviceClosed)
+	}
+
+	m.icmpForwarder.close()
+
+	if m.captureEP != nil {
+		m.StopCapture()
+	}
+	return nil
+}
+
+// InjectPacket delivers a network packet to the stack as if it was read from
+// the link endpoint, so that it is captured too.
+func (m *Tun2ioManager) InjectPacket(protocol tcpip.NetworkProtocolNumber, pkt []byte) {
+	vv := buffer.NewVectorisedView(len(pkt), []buffer.View{buffer.View(pkt)})
+	if m.captureEP != nil {
+		m.captureEP.DeliverNetworkPacket(m.linkEP, protocol, &vv)
+		return
+	}
+	m.nics[0].nic.DeliverNetworkPacket(m.linkEP, protocol, &vv)
+}
+
+// handleInbound handles the packets read from the link of n before the
+// stack, it returns true for the ones it consumed.
+func (m *Tun2ioManager) handleInbound(n *managedNIC, netProto tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) bool {
+	m.tunnelsMu.Lock()
+	policy := m.icmpPolicy
+	m.tunnelsMu.Unlock()
+
+	// Only the echo requests are flattened, the others are told apart by
+	// the headers in the first view
+	if policy == ICMPIgnore || !mayBeEchoRequest(vv.First()) {
+		return false
+	}
+
+	e, ok := parseEchoRequest(vv.ToView())
+	if !ok {
+		return false
+	}
+
+	if policy == ICMPReply || m.IsLocalAddress(e.target) {
+		m.writeRawPacket(n, nil, netProto, buildEchoReply(e))
+		return true
+	}
+
+	write := func(reply []byte) {
+		m.writeRawPacket(n, nil, netProto, reply)
+	}
+	if err := m.icmpForwarder.forward(e, write); err != nil {
+		m.icmpForwarder.logFailure(e, err)
+	}
+	return true
+}
+
+// writeRawPacket sends a network packet built outside of the stack to the
+// link endpoint of n, r is the route of the packet it answers, if any.
+func (m *Tun2ioManager) writeRawPacket(n *managedNIC, r *stack.Route, netProto tcpip.NetworkProtocolNumber, pkt []byte) {
+	if n.linkEP == nil {
+		return
+	}
+
+	hdr := buffer.NewPrependable(0)
+	if err := n.linkEP.WritePacket(r, &hdr, buffer.View(pkt), netProto); err != nil {
+		log.Printf("Write raw packet failed: %s\n", err)
+	}
+}
+
+// openTunnel creates the tunnel of ep, tags it with the domain of its target
+// and connects it through the dialer of its route. UDP tunnels are sniffed
+// by the caller from their first datagram, which is passed as sniffed.
+func (m *Tun2ioManager) openTunnel(network string, wq *waiter.Queue, ep tcpip.Endpoint, sniffed *SniffResult) (*Tunnel, error) {
+	t := NewPendingTunnel(network, wq, ep, m.endpointClosed, &m.config)
+	t.Domain = m.domains.Lookup(t.Id.RemoteAddress)
+
+	m.tunnelsMu.Lock()
+	hijack := m.dnsHijack
+	sniff := (m.sniffPorts[t.Id.RemotePort] || m.classify) && network == "tcp"
+	dialByName := m.dialByName
+	m.tunnelsMu.Unlock()
+
+	if sniff && t.Sniff(m.config.SniffTimeout, tcpSniffers) == nil {
+		sniffed = &t.Sniffed
+	}
+
+	if sniffed != nil {
+		t.Sniffed = *sniffed
+		t.setProtocol(sniffed.Protocol)
+		if sniffed.Host != "" {
+			log.Printf("Sniffed %s %s for %s\n", sniffed.Protocol, sniffed.Host, t.Id.ToString())
+			t.Domain = sniffed.Host
+		}
+		if sniffed.Method != "" {
+			log.Printf("HTTP %s %s %s\n", sniffed.Method, sniffed.Host, sniffed.Path)
+		}
+	}
+
+	if dialByName && t.Domain != "" {
+		t.DialName = t.Domain
+	}
+
+	var dialer proxy.Dialer
+	if hijack && isHijackedDNS(t.Id) {
+		t.Route = "dns-hijack"
+		dialer = &DnsDialer{Handler:m.dnsHandler}
+	} else {
+		var err error
+		if t.Route, dialer, err = m.router.Route(t); err != nil {
+			log.Printf("Tunnel %s not opened by route %s\n", t.ToString(), t.Route)
+			m.logFlow(t, FlowClose, err)
+			return nil, err
+		}
+	}
+
+	if err := t.Connect(dialer); err != nil {
+		m.logFlow(t, FlowClose, err)
+		return nil, err
+	}
+
+	m.logFlow(t, FlowOpen, nil)
+	return t, nil
+}
+
 func (m *Tun2ioManager) MainLoop() {
 	for {
 		time.Sleep(2 * time.Second)
@@ -89,8 +500,8 @@ func (m *Tun2ioManager) MainLoop() {
 func (m *Tun2ioManager) GetDebugStats() string {
 	var ret string = "tunnels:\n"
 
-	for tid, _ := range m.tunnels {
-		ret += tid.ToString() + "\n"
+	for _, t := range m.tunnels {
+		ret += t.ToString() + "\n"
 	}
 
 	ret += "tcpListeners:\n"
@@ -110,6 +521,20 @@ func (m *Tun2ioManager) GetDebugStats() string {
 		}
 	}
 
+	if m.dnsCache != nil {
+		ret += "dnsCache:\n" + m.dnsCache.Stats().ToString() + "\n"
+	}
+
+	if m.dnsFilter != nil {
+		ret += "dnsFilter:\n" + m.dnsFilter.GetDebugStats()
+	}
+
+	if m.captureEP != nil {
+		if c := m.captureEP.Capture(); c != nil {
+			ret += "capture:\n" + c.Stats().ToString() + "\n"
+		}
+	}
+
 	return ret
 }
 
@@ -127,18 +552,27 @@ func (m *Tun2ioManager) tcpHandler(r *stack.Route, id stack.TransportEndpointID,
 		return false
 	}
 
-	demux := m.stack.(*stack.Stack).GetDemuxer(m.nicid)
+	n := m.nicOf(r)
+	if n == nil {
+		return false
+	}
+	demux := m.stack.(*stack.Stack).GetDemuxer(n.id)
 	if demux.IsEndpointExist(netProto, protocol, id) || demux.IsEndpointExist(netProto, protocol, listenId) {
 		return false
 	}
 
 	listenerId := TransportID{Transport:protocol, RemoteAddress: id.LocalAddress, RemotePort:id.LocalPort}
 	log.Printf("Create endpoint with id %s\n", listenerId.ToString())
-	l, err := NewTcpListener(m.stack, m.nicid, netProto, listenerId)
+	tcpConfig := m.GetTCPConfig()
+	config := m.config
+	config.TCP = tcpConfig
+	l, err := NewTcpListenerWithConfig(m.stack, n.id, netProto, listenerId, &config)
 	if err != nil {
 		log.Print(err)
 		return false
 	}
+	tcpConfig.applyEndpoint(l.endpoint)
+
 	m.tunnelsMu.Lock()
 	m.tcpListeners[listenerId] = l
 	m.tcpListener2TcpTunnels[listenerId] = make([]TransportID, 0)
@@ -176,12 +610,14 @@ func (m *Tun2ioManager) tcpHandler(r *stack.Route, id stack.TransportEndpointID,
 		}
 	}()
 
-	m.nic.DeliverTransportPacket(r, protocol, vv)
+	n.nic.DeliverTransportPacket(r, protocol, vv)
 	return true
 }
 
 func (m *Tun2ioManager) tcpCb(listenerId TransportID, wq *waiter.Queue, ep tcpip.Endpoint) {
-	tunnel, err := NewTunnel("tcp", wq, ep, m.defaultDialer, m.endpointClosed)
+	m.GetTCPConfig().applyEndpoint(ep)
+
+	tunnel, err := m.openTunnel("tcp", wq, ep, nil)
 	if err != nil {
 		log.Print(err)
 		ep.Close()
@@ -189,19 +625,18 @@ func (m *Tun2ioManager) tcpCb(listenerId TransportID, wq *waiter.Queue, ep tcpip
 	}
 
 	m.tunnelsMu.Lock()
-	defer m.tunnelsMu.Unlock()
-
 	m.tunnels[tunnel.Id] = tunnel
 	arr := m.tcpListener2TcpTunnels[listenerId]
 	m.tcpListener2TcpTunnels[listenerId] = append(arr, tunnel.Id)
+	m.tunnelsMu.Unlock()
 
 	tunnel.Run()
 }
 
 func (m *Tun2ioManager) endpointClosed(id TransportID) {
 	m.tunnelsMu.Lock()
-	defer m.tunnelsMu.Unlock()
 
+	t := m.tunnels[id]
 	delete(m.tunnels, id)
 
 	if id.Transport == header.TCPProtocolNumber {
@@ -215,6 +650,11 @@ func (m *Tun2ioManager) endpointClosed(id TransportID) {
 			}
 		}
 	}
+	m.tunnelsMu.Unlock()
+
+	if t != nil {
+		m.logFlow(t, FlowClose, t.CloseReason)
+	}
 }
 
 func (m *Tun2ioManager) udpHandler(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) bool {
@@ -226,11 +666,41 @@ func (m *Tun2ioManager) udpHandler(r *stack.Route, id stack.TransportEndpointID,
 		return false
 	}
 
-	demux := m.stack.(*stack.Stack).GetDemuxer(m.nicid)
+	n := m.nicOf(r)
+	if n == nil {
+		return false
+	}
+	demux := m.stack.(*stack.Stack).GetDemuxer(n.id)
 	if demux.IsEndpointExist(netProto, protocol, id) {
 		return false
 	}
 
+	m.tunnelsMu.Lock()
+	quicPolicy := m.quicPolicy
+	sniff := m.sniffPorts[id.LocalPort] || m.classify
+	m.tunnelsMu.Unlock()
+
+	var sniffed *SniffResult
+	transport := vv.ToView()
+	if len(transport) > header.UDPMinimumSize && isQUICInitial(transport[header.UDPMinimumSize:]) {
+		switch quicPolicy {
+		case QUICDrop:
+			log.Printf("Drop QUIC packet of id %v\n", id.ToString())
+			return true
+		case QUICReject:
+			log.Printf("Reject QUIC packet of id %v\n", id.ToString())
+			m.writeRawPacket(n, r, netProto, buildPortUnreachable(id.RemoteAddress, id.LocalAddress, transport))
+			return true
+		}
+	}
+
+	if sniff && len(transport) > header.UDPMinimumSize {
+		var r SniffResult
+		if sniffData(transport[header.UDPMinimumSize:], udpSniffers, &r) == nil {
+			sniffed = &r
+		}
+	}
+
 	log.Printf("Create endpoint with id %s\n", id.ToString())
 
 	var wq waiter.Queue
@@ -240,17 +710,17 @@ func (m *Tun2ioManager) udpHandler(r *stack.Route, id stack.TransportEndpointID,
 		return false
 	}
 
-	if err := ep.Bind(tcpip.FullAddress{m.nicid, id.LocalAddress, id.LocalPort}, nil); err != nil {
+	if err := ep.Bind(tcpip.FullAddress{n.id, id.LocalAddress, id.LocalPort}, nil); err != nil {
 		log.Fatal("Bind failed2: ", err)
 		return false
 	}
 
-	if err := ep.Connect(tcpip.FullAddress{m.nicid, id.RemoteAddress, id.RemotePort}); err != nil {
+	if err := ep.Connect(tcpip.FullAddress{n.id, id.RemoteAddress, id.RemotePort}); err != nil {
 		log.Fatal("Connect failed: ", err)
 		return false
 	}
 
-	tunnel, err := NewTunnel("udp", &wq, ep, m.defaultDialer, m.endpointClosed)
+	tunnel, err := m.openTunnel("udp", &wq, ep, sniffed)
 	if err != nil {
 		log.Print(err)
 		ep.Close()
@@ -262,14 +732,19 @@ func (m *Tun2ioManager) udpHandler(r *stack.Route, id stack.TransportEndpointID,
 	m.tunnelsMu.Unlock()
 
 	tunnel.Run()
-	m.nic.DeliverTransportPacket(r, protocol, vv)
+	n.nic.DeliverTransportPacket(r, protocol, vv)
 	return true
 }
 
 func (m *Tun2ioManager) IsLocalAddress(addr tcpip.Address) bool {
-	for _, sn := range m.subnets {
-		if sn.Contains(addr) {
-			return true
+	m.nicsMu.RLock()
+	defer m.nicsMu.RUnlock()
+
+	for _, n := range m.nics {
+		for _, sn := range n.subnets {
+			if sn.Contains(addr) {
+				return true
+			}
 		}
 	}
 	return false
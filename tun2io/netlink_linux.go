@@ -0,0 +1,374 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// netlink messages are in host byte order
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+const (
+	rtTableMain = 254
+	rtProtBoot = 3
+	rtScopeUniverse = 0
+	rtScopeLink = 253
+	rtnUnicast = 1
+	rtnhFOnlink = 0x4
+
+	frActToTbl = 1
+	fibRuleInvert = 0x2
+	fraPriority = 6
+	fraFwmark = 10
+	fraTable = 15
+	fraFwmask = 16
+)
+
+var errNoDefaultRoute = errors.New("No default route.")
+
+// netlinkConn sends rtnetlink requests and waits for their
+// acknowledgement.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func newNetlinkConn() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family:syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkConn{fd:fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends a message of type typ and returns the error it was answered
+// with.
+func (c *netlinkConn) request(typ uint16, flags uint16, body []byte) error {
+	c.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN + len(body))
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], typ)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags)
+	nativeEndian.PutUint32(msg[8:], c.seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], body)
+
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family:syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq || m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// dump sends a dump request of type typ and returns the messages answered
+// until the end of the dump.
+func (c *netlinkConn) dump(typ uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	c.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN + len(body))
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], typ)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(msg[8:], c.seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], body)
+
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family:syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var result []syscall.NetlinkMessage
+	for {
+		// The messages kept refer to buf, it can't be reused
+		buf := make([]byte, syscall.Getpagesize() * 4)
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return result, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					return nil, syscall.Errno(-int32(nativeEndian.Uint32(m.Data)))
+				}
+				return nil, syscall.EINVAL
+			}
+			result = append(result, m)
+		}
+	}
+}
+
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	attr := make([]byte, (syscall.SizeofRtAttr + len(data) + 3) &^ 3)
+	nativeEndian.PutUint16(attr[0:], uint16(syscall.SizeofRtAttr + len(data)))
+	nativeEndian.PutUint16(attr[2:], typ)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+func uint32Attr(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+// setLink sets the MTU of the link index if mtu is not 0, and its up state.
+func (c *netlinkConn) setLink(index int, mtu int, up bool) error {
+	// ifinfomsg: family(1) pad(1) type(2) index(4) flags(4) change(4)
+	body := make([]byte, syscall.SizeofIfInfomsg)
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	if up {
+		nativeEndian.PutUint32(body[8:], syscall.IFF_UP)
+	}
+	nativeEndian.PutUint32(body[12:], syscall.IFF_UP)
+
+	if mtu > 0 {
+		body = appendAttr(body, syscall.IFLA_MTU, uint32Attr(uint32(mtu)))
+	}
+	return c.request(syscall.RTM_NEWLINK, 0, body)
+}
+
+func ipFamily(ip net.IP) (net.IP, byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, syscall.AF_INET
+	}
+	return ip.To16(), syscall.AF_INET6
+}
+
+// addr adds or deletes the address of a, with the prefix of its mask, on the
+// link index.
+func (c *netlinkConn) addr(typ uint16, index int, a *net.IPNet) error {
+	ip, family := ipFamily(a.IP)
+	ones, _ := a.Mask.Size()
+
+	// ifaddrmsg: family(1) prefixlen(1) flags(1) scope(1) index(4)
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = family
+	body[1] = byte(ones)
+	body[3] = rtScopeUniverse
+	nativeEndian.PutUint32(body[4:], uint32(index))
+	body = appendAttr(body, syscall.IFA_LOCAL, ip)
+	body = appendAttr(body, syscall.IFA_ADDRESS, ip)
+
+	var flags uint16
+	if typ == syscall.RTM_NEWADDR {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE
+	}
+	return c.request(typ, flags, body)
+}
+
+// kernelRoute is a route of the kernel tables. A route without Gateway is
+// scoped to the link Oif, a Table of 0 is the main table.
+type kernelRoute struct {
+	Dst     *net.IPNet
+	Gateway net.IP
+	Oif     int
+	Table   int
+	Metric  int
+	Type    byte
+	Onlink  bool
+}
+
+// kernelRule looks up Table for the packets of Family whose mark is not Mark.
+type kernelRule struct {
+	Family   byte
+	Mark     int
+	Table    int
+	Priority int
+}
+
+// route adds or deletes r, an existing route to the same prefix with the
+// same metric isn't replaced and fails with EEXIST.
+func (c *netlinkConn) route(typ uint16, r *kernelRoute) error {
+	ip, family := ipFamily(r.Dst.IP)
+	ones, _ := r.Dst.Mask.Size()
+
+	// rtmsg: family dst_len src_len tos table protocol scope type flags(4)
+	body := make([]byte, syscall.SizeofRtMsg)
+	body[0] = family
+	body[1] = byte(ones)
+	body[4] = rtTableMain
+	body[5] = rtProtBoot
+	body[6] = rtScopeUniverse
+	body[7] = r.Type
+	if r.Type == 0 {
+		body[7] = rtnUnicast
+	}
+	if body[7] == rtnUnicast && r.Gateway == nil {
+		body[6] = rtScopeLink
+	}
+	if r.Table > 255 {
+		body[4] = 0
+	} else if r.Table > 0 {
+		body[4] = byte(r.Table)
+	}
+	if r.Onlink {
+		nativeEndian.PutUint32(body[8:], rtnhFOnlink)
+	}
+
+	if ones > 0 {
+		body = appendAttr(body, syscall.RTA_DST, ip.Mask(r.Dst.Mask))
+	}
+	if r.Gateway != nil {
+		gw, _ := ipFamily(r.Gateway)
+		body = appendAttr(body, syscall.RTA_GATEWAY, gw)
+	}
+	if r.Oif > 0 {
+		body = appendAttr(body, syscall.RTA_OIF, uint32Attr(uint32(r.Oif)))
+	}
+	if r.Table > 255 {
+		body = appendAttr(body, syscall.RTA_TABLE, uint32Attr(uint32(r.Table)))
+	}
+	if r.Metric > 0 {
+		body = appendAttr(body, syscall.RTA_PRIORITY, uint32Attr(uint32(r.Metric)))
+	}
+
+	var flags uint16
+	if typ == syscall.RTM_NEWROUTE {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	return c.request(typ, flags, body)
+}
+
+// rule adds or deletes r.
+func (c *netlinkConn) rule(typ uint16, r *kernelRule) error {
+	// fib_rule_hdr: family dst_len src_len tos table res1 res2 action flags(4)
+	body := make([]byte, 12)
+	body[0] = r.Family
+	body[7] = frActToTbl
+	nativeEndian.PutUint32(body[8:], fibRuleInvert)
+
+	body = appendAttr(body, fraPriority, uint32Attr(uint32(r.Priority)))
+	body = appendAttr(body, fraFwmark, uint32Attr(uint32(r.Mark)))
+	body = appendAttr(body, fraFwmask, uint32Attr(0xffffffff))
+	body = appendAttr(body, fraTable, uint32Attr(uint32(r.Table)))
+
+	var flags uint16
+	if typ == syscall.RTM_NEWRULE {
+		flags = syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	return c.request(typ, flags, body)
+}
+
+// defaultRoute returns the default route of the main table for family with
+// the lowest metric, skipping the routes through the link skipOif.
+func (c *netlinkConn) defaultRoute(family byte, skipOif int) (*kernelRoute, error) {
+	body := make([]byte, syscall.SizeofRtMsg)
+	body[0] = family
+	msgs, err := c.dump(syscall.RTM_GETROUTE, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *kernelRoute
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if m.Data[0] != family || m.Data[1] != 0 || m.Data[7] != rtnUnicast {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+
+		flags := nativeEndian.Uint32(m.Data[8:])
+		r := &kernelRoute{Table:int(m.Data[4]), Onlink:flags & rtnhFOnlink != 0}
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				r.Gateway = net.IP(a.Value)
+			case syscall.RTA_OIF:
+				r.Oif = int(nativeEndian.Uint32(a.Value))
+			case syscall.RTA_PRIORITY:
+				r.Metric = int(nativeEndian.Uint32(a.Value))
+			case syscall.RTA_TABLE:
+				r.Table = int(nativeEndian.Uint32(a.Value))
+			}
+		}
+
+		if r.Table != rtTableMain || r.Oif == skipOif {
+			continue
+		}
+		if best == nil || r.Metric < best.Metric {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return nil, errNoDefaultRoute
+	}
+	return best, nil
+}
@@ -0,0 +1,354 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/buffer"
+	"github.com/FTwOoO/netstack/tcpip/stack"
+)
+
+var (
+	errUnknownNIC = errors.New("Unknown NIC.")
+	errNICExists = errors.New("NIC already exists.")
+	errFirstNIC = errors.New("The first NIC can't be removed.")
+)
+
+// managedNIC is a NIC of the stack served by the manager.
+type managedNIC struct {
+	id      tcpip.NICID
+	nic     *stack.NIC
+	linkEP  stack.LinkEndpoint
+	subnets []tcpip.Subnet
+
+	// addrs are the addresses added by the manager with their subnets
+	addrs   map[tcpip.Address]tcpip.Subnet
+}
+
+// addStackAddress adds the address of a and its subnet to the NIC nicid.
+func addStackAddress(s tcpip.Stack, nicid tcpip.NICID, a *net.IPNet) (tcpip.Address, tcpip.Subnet, tcpip.NetworkProtocolNumber, error) {
+	addr, subnet, proto, err := ipNetToSubnet(a)
+	if err != nil {
+		return "", tcpip.Subnet{}, 0, err
+	}
+
+	if err := s.AddAddress(nicid, proto, addr); err != nil {
+		return "", tcpip.Subnet{}, 0, err
+	}
+
+	if err := s.(*stack.Stack).AddSubnet(nicid, proto, subnet); err != nil {
+		s.RemoveAddress(nicid, addr)
+		return "", tcpip.Subnet{}, 0, err
+	}
+	return addr, subnet, proto, nil
+}
+
+// removeStackAddresses removes the addresses of addrs and their subnets from
+// the NIC nicid of s.
+func removeStackAddresses(s tcpip.Stack, nicid tcpip.NICID, addrs []*net.IPNet) {
+	for _, a := range addrs {
+		if addr, subnet, _, err := ipNetToSubnet(a); err == nil {
+			s.RemoveAddress(nicid, addr)
+			s.(*stack.Stack).RemoveSubnet(nicid, subnet)
+		}
+	}
+}
+
+func (m *Tun2ioManager) newManagedNIC(nicid tcpip.NICID, linkEP stack.LinkEndpoint) *managedNIC {
+	return &managedNIC{
+		id:nicid,
+		nic:m.stack.(*stack.Stack).GetNic(nicid),
+		linkEP:linkEP,
+		subnets:m.stack.NICSubnets()[nicid],
+		addrs:make(map[tcpip.Address]tcpip.Subnet, 0),
+	}
+}
+
+// hookLink makes the manager see the inbound packets of n before the stack
+// and clamp the MSS of its SYN segments, if its link endpoint is a
+// CaptureEndpoint.
+func (m *Tun2ioManager) hookLink(n *managedNIC) {
+	linkEP := n.linkEP
+	if ep, ok := linkEP.(*CaptureEndpoint); ok {
+		ep.setMSSClamp(uint16(m.GetTCPConfig().MSS))
+		ep.setInbound(func(netProto tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) bool {
+			return m.handleInbound(n, netProto, vv)
+		})
+		linkEP = ep.lower
+	}
+	if ep, ok := linkEP.(*EthernetEndpoint); ok {
+		ep.setClaim(func(addr tcpip.Address) bool {
+			return m.claims(n, addr)
+		})
+	}
+}
+
+// unhookLink undoes hookLink for a NIC which isn't served anymore.
+func (m *Tun2ioManager) unhookLink(n *managedNIC) {
+	linkEP := n.linkEP
+	if ep, ok := linkEP.(*CaptureEndpoint); ok {
+		ep.setInbound(nil)
+		linkEP = ep.lower
+	}
+	if ep, ok := linkEP.(*EthernetEndpoint); ok {
+		ep.setClaim(func(tcpip.Address) bool { return false })
+	}
+}
+
+// claims reports whether the link of n answers for addr: an address of the
+// stack, or one outside of the subnets of n which is proxied.
+func (m *Tun2ioManager) claims(n *managedNIC, addr tcpip.Address) bool {
+	m.nicsMu.RLock()
+	defer m.nicsMu.RUnlock()
+
+	if _, ok := n.addrs[addr]; ok {
+		return true
+	}
+	if _, ok := m.dnsServers[addr]; ok {
+		return true
+	}
+	for _, sn := range n.subnets {
+		if sn.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// findNIC returns the NIC nicid, the caller holds nicsMu.
+func (m *Tun2ioManager) findNIC(nicid tcpip.NICID) *managedNIC {
+	for _, n := range m.nics {
+		if n.id == nicid {
+			return n
+		}
+	}
+	return nil
+}
+
+// nicOf returns the NIC of the route r a packet arrived on, or nil if the
+// NIC isn't served by the manager.
+func (m *Tun2ioManager) nicOf(r *stack.Route) *managedNIC {
+	m.nicsMu.RLock()
+	defer m.nicsMu.RUnlock()
+
+	return m.findNIC(r.NICID())
+}
+
+// updateRoutes routes the subnets of each NIC to it and the rest to the
+// first NIC, the caller holds nicsMu.
+func (m *Tun2ioManager) updateRoutes() {
+	var routes []tcpip.Route
+	for _, n := range m.nics {
+		for _, sn := range n.subnets {
+			routes = append(routes, tcpip.Route{
+				Destination: sn.ID(),
+				Mask:        tcpip.Address(sn.Mask()),
+				NIC:         n.id,
+			})
+		}
+	}
+
+	for _, l := range []int{net.IPv4len, net.IPv6len} {
+		routes = append(routes, tcpip.Route{
+			Destination: tcpip.Address(strings.Repeat("\x00", l)),
+			Mask:        tcpip.Address(strings.Repeat("\x00", l)),
+			NIC:         m.nics[0].id,
+		})
+	}
+	m.stack.SetRouteTable(routes)
+}
+
+// AddNIC creates the NIC nicid on the link endpoint linkId with the addresses
+// addrs, given with the masks of their subnets. Its flows share the tunnels,
+// the routing and the DNS handler of the other NICs.
+func (m *Tun2ioManager) AddNIC(nicid tcpip.NICID, linkId tcpip.LinkEndpointID, addrs []*net.IPNet) error {
+	m.nicsMu.Lock()
+	defer m.nicsMu.Unlock()
+
+	if m.findNIC(nicid) != nil {
+		return errNICExists
+	}
+
+	if err := m.stack.CreateNIC(nicid, linkId); err != nil {
+		return err
+	}
+
+	n := m.newManagedNIC(nicid, stack.FindLinkEndpoint(linkId))
+	for _, a := range addrs {
+		if err := m.addNICAddress(n, a); err != nil {
+			// the stack can't remove a NIC, it is left without address
+			m.clearNIC(n)
+			return err
+		}
+	}
+
+	m.hookLink(n)
+	m.nics = append(m.nics, n)
+	m.updateRoutes()
+	return nil
+}
+
+// RemoveNIC stops serving the NIC nicid, its addresses, subnets and DNS
+// endpoints are removed and the tunnels of its clients are left open. The
+// stack can't remove a NIC, so it stays without address and nicid can't be
+// added again.
+func (m *Tun2ioManager) RemoveNIC(nicid tcpip.NICID) error {
+	m.nicsMu.Lock()
+	defer m.nicsMu.Unlock()
+
+	n := m.findNIC(nicid)
+	if n == nil {
+		return errUnknownNIC
+	}
+	if n == m.nics[0] {
+		return errFirstNIC
+	}
+
+	m.unhookLink(n)
+	err := m.clearNIC(n)
+
+	for i, other := range m.nics {
+		if other == n {
+			m.nics = append(m.nics[:i], m.nics[i + 1:]...)
+			break
+		}
+	}
+	m.updateRoutes()
+	return err
+}
+
+// abort undoes NewTun2IO once the manager is created. The stack can't remove
+// the first NIC either, it is left unhooked and without addresses.
+func (m *Tun2ioManager) abort() {
+	m.Close()
+
+	m.nicsMu.Lock()
+	m.unhookLink(m.nics[0])
+	m.clearNIC(m.nics[0])
+	m.nicsMu.Unlock()
+}
+
+// AddAddress adds the address of a and its subnet to the NIC nicid.
+func (m *Tun2ioManager) AddAddress(nicid tcpip.NICID, a *net.IPNet) error {
+	m.nicsMu.Lock()
+	defer m.nicsMu.Unlock()
+
+	n := m.findNIC(nicid)
+	if n == nil {
+		return errUnknownNIC
+	}
+
+	if err := m.addNICAddress(n, a); err != nil {
+		return err
+	}
+	m.updateRoutes()
+	return nil
+}
+
+// RemoveAddress removes the address of a and its subnet from the NIC nicid,
+// the tunnels of its clients are left open.
+func (m *Tun2ioManager) RemoveAddress(nicid tcpip.NICID, a *net.IPNet) error {
+	m.nicsMu.Lock()
+	defer m.nicsMu.Unlock()
+
+	n := m.findNIC(nicid)
+	if n == nil {
+		return errUnknownNIC
+	}
+
+	addr, subnet, _, err := ipNetToSubnet(a)
+	if err != nil {
+		return err
+	}
+
+	err = m.removeNICAddress(n, addr, subnet)
+	m.updateRoutes()
+	return err
+}
+
+// addNICAddress adds the address of a, its subnet and its DNS endpoint to n,
+// nothing is left added if it fails. The caller holds nicsMu.
+func (m *Tun2ioManager) addNICAddress(n *managedNIC, a *net.IPNet) error {
+	addr, subnet, proto, err := addStackAddress(m.stack, n.id, a)
+	if err != nil {
+		return err
+	}
+	n.addrs[addr] = subnet
+	n.subnets = m.stack.NICSubnets()[n.id]
+
+	if m.dnsHandler != nil {
+		if err := m.createDnsServer(n.id, addr, proto); err != nil {
+			m.removeNICAddress(n, addr, subnet)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeNICAddress removes addr, its subnet and its DNS endpoint from n, the
+// caller holds nicsMu.
+func (m *Tun2ioManager) removeNICAddress(n *managedNIC, addr tcpip.Address, subnet tcpip.Subnet) error {
+	if d, ok := m.dnsServers[addr]; ok {
+		d.Close(errDeviceClosed)
+		delete(m.dnsServers, addr)
+	}
+	delete(n.addrs, addr)
+
+	err := m.stack.RemoveAddress(n.id, addr)
+	if serr := m.stack.(*stack.Stack).RemoveSubnet(n.id, subnet); err == nil {
+		err = serr
+	}
+	n.subnets = m.stack.NICSubnets()[n.id]
+	return err
+}
+
+// clearNIC removes all the addresses added to n and returns the first error,
+// the caller holds nicsMu.
+func (m *Tun2ioManager) clearNIC(n *managedNIC) error {
+	var err error
+	for addr, subnet := range n.addrs {
+		if rerr := m.removeNICAddress(n, addr, subnet); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// createDnsServer starts a DNS endpoint on addr if the manager has a DNS
+// handler, the caller holds nicsMu.
+func (m *Tun2ioManager) createDnsServer(nicid tcpip.NICID, addr tcpip.Address, proto tcpip.NetworkProtocolNumber) error {
+	if m.dnsHandler == nil {
+		return errNoDnsHandler
+	}
+
+	fullAddr := tcpip.FullAddress{NIC:nicid, Addr:addr, Port:m.config.DNSPort}
+	ep, err := CreateUdpEndpointWithConfig(m.stack, proto, fullAddr, &m.config)
+	if err != nil {
+		return err
+	}
+
+	d, err := CreateDnsServerWithConfig(ep, m.dnsHandler, &m.config)
+	if err != nil {
+		return err
+	}
+	m.dnsServers[addr] = d
+	return nil
+}
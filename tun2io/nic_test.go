@@ -0,0 +1,148 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/network/ipv4"
+	"github.com/FTwOoO/netstack/tcpip/network/ipv6"
+)
+
+// routeTableStack records the route table set on the stack.
+type routeTableStack struct {
+	tcpip.Stack
+	routes []tcpip.Route
+}
+
+func (s *routeTableStack) SetRouteTable(routes []tcpip.Route) {
+	s.routes = routes
+}
+
+func mustSubnet(t *testing.T, s string) tcpip.Subnet {
+	_, subnet, _, err := ipNetToSubnet(mustParseNet(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subnet
+}
+
+func mustParseNet(t *testing.T, s string) *net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.IP = ip
+	return n
+}
+
+func TestIPNetToSubnet(t *testing.T) {
+	tests := []struct {
+		name   string
+		ipnet  *net.IPNet
+		addr   net.IP
+		id     net.IP
+		prefix int
+		proto  tcpip.NetworkProtocolNumber
+		err    bool
+	}{
+		{"IPv4", mustParseNet(t, "10.1.2.3/24"), net.IPv4(10, 1, 2, 3), net.IPv4(10, 1, 2, 0), 24, ipv4.ProtocolNumber, false},
+		{"IPv4 in 16 bytes", &net.IPNet{IP:net.IPv4(10, 1, 2, 3), Mask:net.CIDRMask(120, 128)}, net.IPv4(10, 1, 2, 3), net.IPv4(10, 1, 2, 0), 24, ipv4.ProtocolNumber, false},
+		{"IPv6", mustParseNet(t, "fd00::1/64"), net.ParseIP("fd00::1"), net.ParseIP("fd00::"), 64, ipv6.ProtocolNumber, false},
+		{"IPv6 with an IPv4 mask", &net.IPNet{IP:net.ParseIP("fd00::1"), Mask:net.CIDRMask(24, 32)}, nil, nil, 0, 0, true},
+		{"no IP", &net.IPNet{Mask:net.CIDRMask(24, 32)}, nil, nil, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		addr, subnet, proto, err := ipNetToSubnet(tt.ipnet)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !net.IP(addr).Equal(tt.addr) || !net.IP(subnet.ID()).Equal(tt.id) || subnet.Prefix() != tt.prefix || proto != tt.proto {
+			t.Errorf("%s: %s in %s/%d proto %d, want %s in %s/%d proto %d", tt.name, net.IP(addr), net.IP(subnet.ID()),
+				subnet.Prefix(), proto, tt.addr, tt.id, tt.prefix, tt.proto)
+		}
+	}
+}
+
+func TestManagerClaims(t *testing.T) {
+	dns := tcpip.Address(net.IPv4(10, 0, 0, 53).To4())
+	own := tcpip.Address(net.IPv4(10, 0, 0, 1).To4())
+	m := &Tun2ioManager{dnsServers:map[tcpip.Address]*DnsServer{dns:nil}}
+	n := &managedNIC{
+		subnets:[]tcpip.Subnet{mustSubnet(t, "10.0.0.1/24"), mustSubnet(t, "fd00::1/64")},
+		addrs:map[tcpip.Address]tcpip.Subnet{own:mustSubnet(t, "10.0.0.1/24")},
+	}
+
+	tests := []struct {
+		name string
+		addr net.IP
+		want bool
+	}{
+		{"address of the NIC", net.IPv4(10, 0, 0, 1), true},
+		{"DNS server", net.IPv4(10, 0, 0, 53), true},
+		{"neighbor in the subnet", net.IPv4(10, 0, 0, 7), false},
+		{"proxied IPv4", net.IPv4(8, 8, 8, 8), true},
+		{"neighbor in the IPv6 subnet", net.ParseIP("fd00::7"), false},
+		{"proxied IPv6", net.ParseIP("2001:db8::1"), true},
+	}
+
+	for _, tt := range tests {
+		addr := tt.addr.To4()
+		if addr == nil {
+			addr = tt.addr
+		}
+		if got := m.claims(n, tcpip.Address(addr)); got != tt.want {
+			t.Errorf("%s: claimed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManagerUpdateRoutes(t *testing.T) {
+	s := new(routeTableStack)
+	m := &Tun2ioManager{
+		stack:s,
+		nics:[]*managedNIC{
+			{id:1, subnets:[]tcpip.Subnet{mustSubnet(t, "10.0.0.1/24")}},
+			{id:2, subnets:[]tcpip.Subnet{mustSubnet(t, "192.168.1.1/24"), mustSubnet(t, "fd00::1/64")}},
+		},
+	}
+	m.updateRoutes()
+
+	want := []string{
+		"10.0.0.0/ffffff00 nic 1",
+		"192.168.1.0/ffffff00 nic 2",
+		"fd00::/ffffffffffffffff0000000000000000 nic 2",
+		"0.0.0.0/00000000 nic 1",
+		"::/00000000000000000000000000000000 nic 1",
+	}
+	var got []string
+	for _, r := range s.routes {
+		got = append(got, fmt.Sprintf("%s/%x nic %d", net.IP(r.Destination), []byte(r.Mask), r.NIC))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Routes\n%v\nwant\n%v", got, want)
+	}
+}
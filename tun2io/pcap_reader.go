@@ -0,0 +1,309 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// directions of a packet, from the epb_flags of pcapng
+const (
+	DirectionUnknown  = 0
+	DirectionInbound  = 1
+	DirectionOutbound = 2
+)
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+var (
+	errBadPcap = errors.New("Not a pcap or pcapng file.")
+	errPcapTooBig = errors.New("Pcap record is too big.")
+)
+
+// maximum size of a record accepted by PcapReader
+const maxPcapRecord = 1 << 24
+
+// PcapPacket is an IP packet read from a capture file.
+type PcapPacket struct {
+	Time      time.Time
+	Data      []byte
+	Direction int
+}
+
+// PcapReader reads the IP packets of a pcap or pcapng file, the packets of
+// other protocols are skipped. Raw IP, Ethernet, Linux cooked and BSD
+// loopback link types are supported.
+type PcapReader struct {
+	r         *bufio.Reader
+	ng        bool
+	order     binary.ByteOrder
+
+	// classic pcap
+	linkType  uint32
+	nanosec   bool
+
+	// pcapng, per interface
+	linkTypes []uint32
+	tsUnits   []time.Duration
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	p := &PcapReader{r:bufio.NewReader(r)}
+
+	magic, err := p.r.Peek(4)
+	if err != nil {
+		return nil, errBadPcap
+	}
+
+	switch {
+	case binary.BigEndian.Uint32(magic) == 0x0a0d0d0a:
+		p.ng = true
+		return p, nil
+	case binary.LittleEndian.Uint32(magic) == 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == 0xa1b2c3d4:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(magic) == 0xa1b23c4d:
+		p.order, p.nanosec = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(magic) == 0xa1b23c4d:
+		p.order, p.nanosec = binary.BigEndian, true
+	default:
+		return nil, errBadPcap
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		return nil, errBadPcap
+	}
+	p.linkType = p.order.Uint32(hdr[20:]) & 0xffff
+	return p, nil
+}
+
+// Next returns the next IP packet, or io.EOF at the end of the file.
+func (p *PcapReader) Next() (*PcapPacket, error) {
+	for {
+		var pkt *PcapPacket
+		var err error
+		if p.ng {
+			pkt, err = p.nextBlock()
+		} else {
+			pkt, err = p.nextRecord()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt != nil && pkt.Data != nil {
+			return pkt, nil
+		}
+	}
+}
+
+func (p *PcapReader) nextRecord() (*PcapPacket, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	capLen := p.order.Uint32(hdr[8:])
+	if capLen > maxPcapRecord {
+		return nil, errPcapTooBig
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, io.EOF
+	}
+
+	frac := time.Duration(p.order.Uint32(hdr[4:]))
+	if !p.nanosec {
+		frac *= time.Microsecond
+	}
+	ts := time.Unix(int64(p.order.Uint32(hdr[0:])), int64(frac))
+
+	return &PcapPacket{Time:ts, Data:linkPayload(p.linkType, data)}, nil
+}
+
+func (p *PcapReader) nextBlock() (*PcapPacket, error) {
+	hdr, err := p.r.Peek(12)
+	if err != nil {
+		return nil, io.EOF
+	}
+
+	// the byte order of a section is given by its header block
+	if binary.BigEndian.Uint32(hdr) == 0x0a0d0d0a {
+		if binary.LittleEndian.Uint32(hdr[8:]) == 0x1a2b3c4d {
+			p.order = binary.LittleEndian
+		} else {
+			p.order = binary.BigEndian
+		}
+		p.linkTypes = nil
+		p.tsUnits = nil
+	}
+
+	blockType := p.order.Uint32(hdr[0:])
+	blockLen := p.order.Uint32(hdr[4:])
+	if blockLen < 12 || blockLen > maxPcapRecord {
+		return nil, errPcapTooBig
+	}
+	block := make([]byte, blockLen)
+	if _, err := io.ReadFull(p.r, block); err != nil {
+		return nil, io.EOF
+	}
+	body := block[8:blockLen - 4]
+
+	switch blockType {
+	case 1:
+		// interface description block
+		if len(body) < 8 {
+			return nil, errBadPcap
+		}
+		unit := time.Microsecond
+		forEachPcapngOption(p.order, body[8:], func(code uint16, value []byte) {
+			if code == 9 && len(value) == 1 {
+				// if_tsresol
+				unit = pcapngTimeUnit(value[0])
+			}
+		})
+		p.linkTypes = append(p.linkTypes, uint32(p.order.Uint16(body[0:])))
+		p.tsUnits = append(p.tsUnits, unit)
+		return nil, nil
+	case 6:
+		// enhanced packet block
+		if len(body) < 20 {
+			return nil, errBadPcap
+		}
+		iface := p.order.Uint32(body[0:])
+		if int(iface) >= len(p.linkTypes) {
+			return nil, errBadPcap
+		}
+		capLen := int(p.order.Uint32(body[12:]))
+		if len(body) < 20 + capLen {
+			return nil, errBadPcap
+		}
+
+		ts := uint64(p.order.Uint32(body[4:])) << 32 | uint64(p.order.Uint32(body[8:]))
+		pkt := &PcapPacket{
+			Time:time.Unix(0, 0).Add(time.Duration(ts) * p.tsUnits[iface]),
+			Data:linkPayload(p.linkTypes[iface], body[20:20 + capLen]),
+		}
+		// the options follow the data padded to 32 bits, a block without the
+		// padding has no options
+		if off := 20 + (capLen + 3) &^ 3; off <= len(body) {
+			forEachPcapngOption(p.order, body[off:], func(code uint16, value []byte) {
+				if code == 2 && len(value) == 4 {
+					// epb_flags
+					pkt.Direction = int(p.order.Uint32(value) & 0x3)
+				}
+			})
+		}
+		return pkt, nil
+	case 3:
+		// simple packet block, without timestamp
+		if len(body) < 4 || len(p.linkTypes) == 0 {
+			return nil, errBadPcap
+		}
+		return &PcapPacket{Data:linkPayload(p.linkTypes[0], body[4:])}, nil
+	}
+	return nil, nil
+}
+
+func forEachPcapngOption(order binary.ByteOrder, opts []byte, f func(code uint16, value []byte)) {
+	for len(opts) >= 4 {
+		code := order.Uint16(opts[0:])
+		l := int(order.Uint16(opts[2:]))
+		if code == 0 || len(opts) < 4 + l {
+			return
+		}
+		f(code, opts[4:4 + l])
+		next := 4 + (l + 3) &^ 3
+		if next > len(opts) {
+			return
+		}
+		opts = opts[next:]
+	}
+}
+
+// pcapngTimeUnit decodes if_tsresol, a power of 10 or of 2 if the high bit
+// is set.
+func pcapngTimeUnit(v byte) time.Duration {
+	unit := time.Second
+	if v & 0x80 != 0 {
+		unit >>= v & 0x7f
+	} else {
+		for i := byte(0); i < v; i++ {
+			unit /= 10
+		}
+	}
+	if unit == 0 {
+		unit = time.Nanosecond
+	}
+	return unit
+}
+
+// linkPayload returns the IP packet in frame, or nil if it carries another
+// protocol.
+func linkPayload(linkType uint32, frame []byte) []byte {
+	var proto uint16
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6, 12:
+		// 12 is raw IP on some BSDs
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil
+		}
+		frame = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		proto = binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for proto == 0x8100 && len(frame) >= 4 {
+			proto = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		proto = binary.BigEndian.Uint16(frame[14:])
+		frame = frame[16:]
+	default:
+		return nil
+	}
+
+	if proto != 0 && proto != 0x0800 && proto != 0x86dd {
+		return nil
+	}
+	if len(frame) < 1 || (frame[0] >> 4 != 4 && frame[0] >> 4 != 6) {
+		return nil
+	}
+	return frame
+}
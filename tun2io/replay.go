@@ -0,0 +1,140 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"io"
+	"net"
+	"time"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	replayMTU uint32 = 1500
+	replayQueueSize = 1024
+)
+
+type ReplayConfig struct {
+	// Speed divides the delays between the packets of the file, 1 keeps the
+	// original timing and 0 injects the packets without waiting
+	Speed     float64
+
+	// ClientNet selects the packets injected by their source address. If it
+	// is nil, the packets captured as inbound are injected, or if the file has
+	// no direction all of them, unless Manager is set.
+	ClientNet *net.IPNet
+
+	// Manager is the manager of the stack replayed into. If it is set, the
+	// packets of a file without direction are injected only if their source
+	// is a client address of its NICs, the others are the stack's own.
+	Manager   *Tun2ioManager
+
+	// Linger is how long packets are still collected after the last one is
+	// injected
+	Linger    time.Duration
+}
+
+type ReplayResult struct {
+	Injected int
+	Skipped  int
+
+	// Emitted are the packets written by the stack during the replay
+	Emitted  []PcapPacket
+}
+
+// NewMemoryTun2IO starts a manager like Tun2IO on a new MemoryEndpoint
+// instead of a device, packets are pushed with its Inject method and pulled
+// from its C channel.
+func NewMemoryTun2IO(ip net.IP, subnet *net.IPNet, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, *MemoryEndpoint, error) {
+	linkID, ep := NewMemoryEndpoint(replayMTU, replayQueueSize)
+	linkID, _ = NewCaptureEndpoint(linkID)
+	m, err := Tun2IO(ip, subnet, linkID, createDNSEndpoint, dialer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, ep, nil
+}
+
+func (c *ReplayConfig) isClient(p *PcapPacket) bool {
+	if c.ClientNet != nil {
+		info, ok := parseCapturePacket(p.Data)
+		return ok && c.ClientNet.Contains(info.src)
+	}
+	if p.Direction == DirectionUnknown && c.Manager != nil {
+		info, ok := parseCapturePacket(p.Data)
+		return ok && c.Manager.IsLocalAddress(ipToAddress(info.src))
+	}
+	return p.Direction != DirectionOutbound
+}
+
+// Replay injects the client packets of r into the stack of ep and collects
+// the packets the stack writes until Linger after the last one.
+func Replay(ep *MemoryEndpoint, r *PcapReader, config ReplayConfig) (*ReplayResult, error) {
+	result := &ReplayResult{}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case pkt := <-ep.C:
+				result.Emitted = append(result.Emitted, PcapPacket{Time:time.Now(), Data:pkt, Direction:DirectionOutbound})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var err error
+	var first time.Time
+	start := time.Now()
+	for {
+		var p *PcapPacket
+		if p, err = r.Next(); err != nil {
+			break
+		}
+
+		if !config.isClient(p) {
+			result.Skipped++
+			continue
+		}
+
+		if config.Speed > 0 && !p.Time.IsZero() {
+			if first.IsZero() {
+				first = p.Time
+			}
+			at := start.Add(time.Duration(float64(p.Time.Sub(first)) / config.Speed))
+			if d := at.Sub(time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		ep.Inject(p.Data)
+		result.Injected++
+	}
+
+	time.Sleep(config.Linger)
+	close(stop)
+	<-done
+
+	if err != io.EOF {
+		return result, err
+	}
+	return result, nil
+}
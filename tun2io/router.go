@@ -0,0 +1,187 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// the route of the dialer given to NewTun2ioManager
+	RouteDefault = "default"
+
+	// the route that rejects flows
+	RouteBlock = "block"
+)
+
+var (
+	ErrBlocked = errors.New("Blocked by route rule.")
+	errUnknownRoute = errors.New("Unknown route.")
+)
+
+// RouteRule sends the tunnels it matches to the dialer named Route. All
+// criteria set must match, a domain matches a suffix if it is the suffix or
+// one of its subdomains. Protocols are the Proto labels of the sniffers,
+// tunnels are only labelled if sniffing or classifying is on.
+type RouteRule struct {
+	Network   string
+	Domains   []string
+	Networks  []*net.IPNet
+	Ports     []uint16
+	Protocols []string
+	Route     string
+}
+
+func (r *RouteRule) match(t *Tunnel) bool {
+	if r.Network != "" && r.Network != t.Id.Network() {
+		return false
+	}
+
+	if len(r.Domains) > 0 {
+		if t.Domain == "" {
+			return false
+		}
+
+		found := false
+		for _, suffix := range r.Domains {
+			suffix = strings.TrimSuffix(strings.ToLower(suffix), ".")
+			if t.Domain == suffix || strings.HasSuffix(t.Domain, "." + suffix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Networks) > 0 {
+		ip := net.IP(t.Id.RemoteAddress)
+		found := false
+		for _, n := range r.Networks {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			if p == t.Id.RemotePort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Protocols) > 0 {
+		proto := t.Protocol()
+		found := false
+		for _, p := range r.Protocols {
+			if strings.EqualFold(p, proto) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Router picks the dialer of a tunnel by the first matching rule, tunnels
+// matching no rule use the RouteDefault dialer.
+type Router struct {
+	mu      sync.RWMutex
+	dialers map[string]proxy.Dialer
+	rules   []RouteRule
+}
+
+func NewRouter(defaultDialer proxy.Dialer) *Router {
+	r := &Router{dialers:make(map[string]proxy.Dialer, 0)}
+	r.dialers[RouteDefault] = defaultDialer
+	return r
+}
+
+// AddDialer registers d as the route name, a nil dialer blocks the flows.
+func (r *Router) AddDialer(name string, d proxy.Dialer) {
+	r.mu.Lock()
+	r.dialers[name] = d
+	r.mu.Unlock()
+}
+
+func (r *Router) AddRule(rule RouteRule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.dialers[rule.Route]; !ok && rule.Route != RouteBlock {
+		return errUnknownRoute
+	}
+
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Route returns the name and the dialer of the route for t.
+func (r *Router) Route(t *Tunnel) (string, proxy.Dialer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name := RouteDefault
+	for i := range r.rules {
+		if r.rules[i].match(t) {
+			name = r.rules[i].Route
+			break
+		}
+	}
+
+	d := r.dialers[name]
+	if d == nil {
+		return name, nil, ErrBlocked
+	}
+	return name, d, nil
+}
+
+// UpstreamAddrs returns the upstream servers of the dialers implementing the
+// UpstreamDialer interface.
+func (r *Router) UpstreamAddrs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var addrs []string
+	for _, d := range r.dialers {
+		if u, ok := d.(UpstreamDialer); ok {
+			addrs = append(addrs, u.UpstreamAddrs()...)
+		}
+	}
+	return addrs
+}
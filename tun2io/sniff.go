@@ -0,0 +1,407 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"github.com/miekg/dns"
+)
+
+var (
+	errSniffIncomplete = errors.New("Need more data to sniff.")
+	errSniffMismatch = errors.New("Unknown protocol.")
+)
+
+// application protocols detected by the sniffers
+const (
+	ProtoTLS        = "tls"
+	ProtoHTTP       = "http"
+	ProtoSSH        = "ssh"
+	ProtoDNS        = "dns"
+	ProtoQUIC       = "quic"
+	ProtoBitTorrent = "bittorrent"
+	ProtoSTUN       = "stun"
+	ProtoUnknown    = "unknown"
+)
+
+var (
+	// sniffers of the first bytes sent by TCP clients
+	tcpSniffers = []sniffer{sniffTLS, sniffHTTP, sniffSSH, sniffBitTorrent, sniffDNSStream}
+
+	// sniffers of the first bytes sent by TCP servers, which are only used to
+	// label tunnels whose client did not speak first
+	tcpServerSniffers = []sniffer{sniffSSH, sniffHTTPResponse}
+
+	// sniffers of the first datagram sent by UDP clients
+	udpSniffers = []sniffer{sniffQUIC, classifyQUIC, sniffDNS, sniffSTUN, sniffBitTorrentUDP}
+
+	// sniffers of the first datagram sent by UDP servers, for the flows the
+	// client datagram didn't tell
+	udpServerSniffers = []sniffer{classifyQUIC, sniffDNSResponse, sniffSTUN, sniffBitTorrentUDP}
+)
+
+const (
+	// TCP DNS queries are much shorter than the 64KB the length allows
+	dnsStreamMaxQuery = 4096
+)
+
+// SniffResult is what the sniffers learned from the first bytes of a flow.
+type SniffResult struct {
+	Protocol string
+	Host     string
+	ALPN     []string
+
+	// Method and Path of the first HTTP request
+	Method   string
+	Path     string
+}
+
+var httpMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// sniffer parses the first bytes of a flow into r, it returns
+// errSniffIncomplete if it needs more data and errSniffMismatch if the flow is
+// not of its protocol.
+type sniffer func(data []byte, r *SniffResult) error
+
+// sniffData runs sniffers on data, it returns errSniffIncomplete if any of
+// them needs more data and none succeeded.
+func sniffData(data []byte, sniffers []sniffer, r *SniffResult) error {
+	ret := errSniffMismatch
+	for _, sniff := range sniffers {
+		err := sniff(data, r)
+		if err == nil {
+			return nil
+		}
+		if err == errSniffIncomplete {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// sniffTLS parses the server name and the ALPN protocols of a TLS
+// ClientHello.
+func sniffTLS(data []byte, r *SniffResult) error {
+	// record header: type(1) version(2) length(2)
+	if len(data) < 5 {
+		if len(data) > 0 && data[0] != 0x16 {
+			return errSniffMismatch
+		}
+		return errSniffIncomplete
+	}
+	if data[0] != 0x16 || data[1] != 0x03 {
+		return errSniffMismatch
+	}
+
+	recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5 + recordLen {
+		return errSniffIncomplete
+	}
+
+	// handshake header: type(1) length(3)
+	hs := data[5:5 + recordLen]
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return errSniffMismatch
+	}
+	hsLen := int(hs[1]) << 16 | int(hs[2]) << 8 | int(hs[3])
+	if len(hs) < 4 + hsLen {
+		// ClientHello spanning several records is not supported
+		return errSniffMismatch
+	}
+
+	return parseClientHello(hs[4:4 + hsLen], false, r)
+}
+
+// parseClientHello parses the body of a ClientHello handshake message. If
+// truncated is true, hello is only the start of the message and the
+// extensions are parsed as far as they go.
+func parseClientHello(hello []byte, truncated bool, r *SniffResult) error {
+	// version(2) random(32) session_id
+	if len(hello) < 35 {
+		return errSniffMismatch
+	}
+	p := 34
+	p += 1 + int(hello[p])
+
+	// cipher_suites
+	if len(hello) < p + 2 {
+		return errSniffMismatch
+	}
+	p += 2 + int(binary.BigEndian.Uint16(hello[p:]))
+
+	// compression_methods
+	if len(hello) < p + 1 {
+		return errSniffMismatch
+	}
+	p += 1 + int(hello[p])
+
+	r.Protocol = ProtoTLS
+	if len(hello) < p + 2 {
+		return nil
+	}
+	extLen := int(binary.BigEndian.Uint16(hello[p:]))
+	p += 2
+	if len(hello) < p + extLen {
+		if !truncated {
+			return errSniffMismatch
+		}
+		extLen = len(hello) - p
+	}
+
+	exts := hello[p:p + extLen]
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		l := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4 + l {
+			if truncated {
+				break
+			}
+			return errSniffMismatch
+		}
+		ext := exts[4:4 + l]
+		exts = exts[4 + l:]
+
+		switch extType {
+		case 0x0000:
+			if name := parseServerName(ext); net.ParseIP(name) == nil {
+				r.Host = name
+			}
+		case 0x0010:
+			r.ALPN = parseALPN(ext)
+		}
+	}
+
+	return nil
+}
+
+func parseServerName(ext []byte) string {
+	// server_name_list length(2), then name_type(1) length(2) name
+	if len(ext) < 2 {
+		return ""
+	}
+	list := ext[2:]
+	for len(list) >= 3 {
+		nameType := list[0]
+		l := int(binary.BigEndian.Uint16(list[1:]))
+		if len(list) < 3 + l {
+			return ""
+		}
+		if nameType == 0 {
+			return strings.ToLower(string(list[3:3 + l]))
+		}
+		list = list[3 + l:]
+	}
+	return ""
+}
+
+func parseALPN(ext []byte) []string {
+	// protocol_name_list length(2), then length(1) name
+	if len(ext) < 2 {
+		return nil
+	}
+
+	var protos []string
+	list := ext[2:]
+	for len(list) >= 1 {
+		l := int(list[0])
+		if len(list) < 1 + l {
+			break
+		}
+		protos = append(protos, string(list[1:1 + l]))
+		list = list[1 + l:]
+	}
+	return protos
+}
+
+// sniffHTTP parses the request line and the Host header of the first HTTP/1.x
+// request, later pipelined requests are left alone.
+func sniffHTTP(data []byte, r *SniffResult) error {
+	found := false
+	for _, m := range httpMethods {
+		prefix := m + " "
+		if len(data) < len(prefix) {
+			if strings.HasPrefix(prefix, string(data)) {
+				found = true
+				break
+			}
+		} else if string(data[:len(prefix)]) == prefix {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errSniffMismatch
+	}
+
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return errSniffIncomplete
+	}
+
+	lines := strings.Split(string(data[:end]), "\r\n")
+	request := strings.Fields(lines[0])
+	if len(request) != 3 || !strings.HasPrefix(request[2], "HTTP/1.") {
+		return errSniffMismatch
+	}
+
+	r.Protocol = ProtoHTTP
+	r.Method = request[0]
+	r.Path = request[1]
+
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ":")
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "host") {
+			continue
+		}
+
+		host := strings.ToLower(strings.TrimSpace(line[i + 1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			r.Host = host
+		}
+		break
+	}
+
+	return nil
+}
+
+// matchPrefix tells whether data starts with prefix, it returns
+// errSniffIncomplete if data is shorter but matches so far.
+func matchPrefix(data []byte, prefix string) error {
+	if len(data) < len(prefix) {
+		if strings.HasPrefix(prefix, string(data)) {
+			return errSniffIncomplete
+		}
+		return errSniffMismatch
+	}
+	if string(data[:len(prefix)]) != prefix {
+		return errSniffMismatch
+	}
+	return nil
+}
+
+func sniffHTTPResponse(data []byte, r *SniffResult) error {
+	if err := matchPrefix(data, "HTTP/1."); err != nil {
+		return err
+	}
+	r.Protocol = ProtoHTTP
+	return nil
+}
+
+// sniffSSH matches the identification string both SSH peers send first.
+func sniffSSH(data []byte, r *SniffResult) error {
+	if err := matchPrefix(data, "SSH-"); err != nil {
+		return err
+	}
+	r.Protocol = ProtoSSH
+	return nil
+}
+
+// sniffBitTorrent matches the handshake of the BitTorrent peer protocol.
+func sniffBitTorrent(data []byte, r *SniffResult) error {
+	if err := matchPrefix(data, "\x13BitTorrent protocol"); err != nil {
+		return err
+	}
+	r.Protocol = ProtoBitTorrent
+	return nil
+}
+
+// sniffBitTorrentUDP matches DHT messages and UDP tracker connect requests.
+func sniffBitTorrentUDP(data []byte, r *SniffResult) error {
+	tracker := []byte{0x00, 0x00, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}
+	dht := bytes.HasPrefix(data, []byte("d1:")) && (bytes.Contains(data, []byte("1:y1:q")) || bytes.Contains(data, []byte("1:y1:r")))
+	if !dht && !(len(data) >= 16 && bytes.HasPrefix(data, tracker)) {
+		return errSniffMismatch
+	}
+	r.Protocol = ProtoBitTorrent
+	return nil
+}
+
+// sniffSTUN matches a STUN message with the magic cookie of RFC 5389.
+func sniffSTUN(data []byte, r *SniffResult) error {
+	if len(data) < 20 || data[0] & 0xc0 != 0 || binary.BigEndian.Uint32(data[4:]) != 0x2112a442 {
+		return errSniffMismatch
+	}
+	if int(binary.BigEndian.Uint16(data[2:])) + 20 != len(data) {
+		return errSniffMismatch
+	}
+	r.Protocol = ProtoSTUN
+	return nil
+}
+
+func sniffDNS(data []byte, r *SniffResult) error {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil || m.Response || len(m.Question) == 0 {
+		return errSniffMismatch
+	}
+	r.Protocol = ProtoDNS
+	return nil
+}
+
+// sniffDNSResponse matches a DNS response.
+func sniffDNSResponse(data []byte, r *SniffResult) error {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil || !m.Response {
+		return errSniffMismatch
+	}
+	r.Protocol = ProtoDNS
+	return nil
+}
+
+// sniffDNSStream matches a length prefixed DNS query over TCP. The header is
+// checked before waiting for the rest of the query, so that other protocols
+// are told apart from their first bytes.
+func sniffDNSStream(data []byte, r *SniffResult) error {
+	if len(data) < 2 {
+		return errSniffIncomplete
+	}
+	l := int(binary.BigEndian.Uint16(data))
+	if l < 12 || l > dnsStreamMaxQuery {
+		return errSniffMismatch
+	}
+
+	// A standard query, without the reserved Z bit and with one question,
+	// the flags follow the id
+	if len(data) >= 6 && (data[4] & 0xf8 != 0 || data[5] & 0x40 != 0) {
+		return errSniffMismatch
+	}
+	if len(data) >= 8 && binary.BigEndian.Uint16(data[6:]) != 1 {
+		return errSniffMismatch
+	}
+
+	if len(data) < 2 + l {
+		return errSniffIncomplete
+	}
+	return sniffDNS(data[2:2 + l], r)
+}
+
+// classifyQUIC labels QUIC Initial packets whose ClientHello could not be
+// parsed by sniffQUIC.
+func classifyQUIC(data []byte, r *SniffResult) error {
+	if !isQUICInitial(data) {
+		return errSniffMismatch
+	}
+	r.Protocol = ProtoQUIC
+	return nil
+}
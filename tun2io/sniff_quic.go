@@ -0,0 +1,278 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+type QUICPolicy int
+
+const (
+	QUICAllow  QUICPolicy = iota // tunnel QUIC like other UDP flows
+	QUICDrop                     // drop QUIC packets silently
+	QUICReject                   // answer QUIC packets with ICMP port unreachable
+)
+
+const quicVersion1 = 0x00000001
+
+// initial salt of QUIC version 1, RFC 9001 section 5.2
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// isQUICInitial tells whether data starts with the long header of a QUIC
+// version 1 Initial packet.
+func isQUICInitial(data []byte) bool {
+	return len(data) >= 5 && data[0] & 0xf0 == 0xc0 && binary.BigEndian.Uint32(data[1:5]) == quicVersion1
+}
+
+// sniffQUIC decrypts a client Initial packet as described in RFC 9001 and
+// parses the ClientHello carried in its CRYPTO frames. Only the part of the
+// ClientHello found in data is parsed.
+func sniffQUIC(data []byte, r *SniffResult) error {
+	if !isQUICInitial(data) {
+		return errSniffMismatch
+	}
+
+	// flags(1) version(4) dcid_len(1) dcid scid_len(1) scid
+	p := 5
+	if len(data) < p + 1 {
+		return errSniffMismatch
+	}
+	dcidLen := int(data[p])
+	p++
+	if dcidLen > 20 || len(data) < p + dcidLen + 1 {
+		return errSniffMismatch
+	}
+	dcid := data[p:p + dcidLen]
+	p += dcidLen
+	p += 1 + int(data[p])
+
+	// token_length token length
+	tokenLen, n := readVarint(data[minInt(p, len(data)):])
+	if n == 0 {
+		return errSniffMismatch
+	}
+	p += n + int(tokenLen)
+	length, n := readVarint(data[minInt(p, len(data)):])
+	if n == 0 {
+		return errSniffMismatch
+	}
+	p += n
+	pnOffset := p
+	if len(data) < pnOffset + int(length) || length < 20 {
+		return errSniffMismatch
+	}
+
+	key, iv, hp := quicClientInitialKeys(dcid)
+
+	// remove the header protection, RFC 9001 section 5.4
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, data[pnOffset + 4:pnOffset + 4 + aes.BlockSize])
+
+	header := make([]byte, pnOffset + 4)
+	copy(header, data)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0] & 0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset + i] ^= mask[1 + i]
+		pn = pn << 8 | uint64(header[pnOffset + i])
+	}
+	header = header[:pnOffset + pnLen]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce) - 1 - i] ^= byte(pn >> uint(8 * i))
+	}
+
+	payload, err := aead.Open(nil, nonce, data[pnOffset + pnLen:pnOffset + int(length)], header)
+	if err != nil {
+		return errSniffMismatch
+	}
+
+	crypto := quicCryptoData(payload)
+
+	// handshake header: type(1) length(3)
+	if len(crypto) < 4 || crypto[0] != 0x01 {
+		return errSniffMismatch
+	}
+	hsLen := int(crypto[1]) << 16 | int(crypto[2]) << 8 | int(crypto[3])
+	hello := crypto[4:]
+	truncated := len(hello) < hsLen
+	if !truncated {
+		hello = hello[:hsLen]
+	}
+
+	if err := parseClientHello(hello, truncated, r); err != nil {
+		return err
+	}
+	r.Protocol = ProtoQUIC
+	return nil
+}
+
+// quicCryptoData returns the contiguous CRYPTO stream data from offset 0 found
+// in the frames of payload.
+func quicCryptoData(payload []byte) []byte {
+	type fragment struct {
+		offset uint64
+		data   []byte
+	}
+	var fragments []fragment
+
+	Frames:for len(payload) > 0 {
+		frameType, n := readVarint(payload)
+		if n == 0 {
+			break
+		}
+		payload = payload[n:]
+
+		switch frameType {
+		case 0x00, 0x01:
+			// PADDING, PING
+		case 0x02, 0x03:
+			// ACK: largest delay range_count first_range (gap range)* [ecn counts]
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], n = readVarint(payload); n == 0 {
+					break Frames
+				}
+				payload = payload[n:]
+			}
+			count := 2 * fields[2]
+			if frameType == 0x03 {
+				count += 3
+			}
+			for i := uint64(0); i < count; i++ {
+				if _, n = readVarint(payload); n == 0 {
+					break Frames
+				}
+				payload = payload[n:]
+			}
+		case 0x06:
+			offset, n := readVarint(payload)
+			if n == 0 {
+				break Frames
+			}
+			payload = payload[n:]
+			l, n := readVarint(payload)
+			if n == 0 || uint64(len(payload) - n) < l {
+				break Frames
+			}
+			fragments = append(fragments, fragment{offset, payload[n:n + int(l)]})
+			payload = payload[n + int(l):]
+		default:
+			break Frames
+		}
+	}
+
+	sort.Slice(fragments, func(i, j int) bool {
+		return fragments[i].offset < fragments[j].offset
+	})
+
+	var crypto []byte
+	for _, f := range fragments {
+		if f.offset > uint64(len(crypto)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(crypto)) {
+			crypto = append(crypto, f.data[uint64(len(crypto)) - f.offset:]...)
+		}
+	}
+	return crypto
+}
+
+// readVarint reads a QUIC variable-length integer, n is 0 if data is too
+// short.
+func readVarint(data []byte) (v uint64, n int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+
+	n = 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0
+	}
+
+	v = uint64(data[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v << 8 | uint64(data[i])
+	}
+	return v, n
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// quicClientInitialKeys derives the packet protection keys of the client
+// Initial packets, RFC 9001 section 5.2.
+func quicClientInitialKeys(dcid []byte) (key, iv, hp []byte) {
+	initialSecret := hkdfExtract(quicInitialSalt, dcid)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+
+	key = hkdfExpandLabel(clientSecret, "quic key", 16)
+	iv = hkdfExpandLabel(clientSecret, "quic iv", 12)
+	hp = hkdfExpandLabel(clientSecret, "quic hp", 16)
+	return
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context, for
+// lengths up to one SHA-256 block.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4 + len(label))
+	info = append(info, byte(length >> 8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
@@ -0,0 +1,187 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The client Initial of RFC 9001 Appendix A
+const (
+	rfc9001DCID   = "8394c8f03e515708"
+	rfc9001Header = "c300000001088394c8f03e5157080000449e00000002"
+	rfc9001Crypto = "060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e868" +
+		"04fe3a47f06a2b69484c00000413011302010000c000000010000e00000b6578" +
+		"616d706c652e636f6dff01000100000a00080006001d00170018001000070005" +
+		"04616c706e000500050100000000003300260024001d00209370b2c9caa47fba" +
+		"baf4559fedba753de171fa71f50f1ce15d43e994ec74d748002b000302030400" +
+		"0d0010000e0403050306030203080408050806002d00020101001c0002400100" +
+		"3900320408ffffffffffffffff05048000ffff07048000ffff08011001048000" +
+		"75300901100f088394c8f03e51570806048000ffff"
+
+	// the protected header and the sample of the header protection
+	rfc9001Protected = "c000000001088394c8f03e5157080000449e7b9aec34"
+	rfc9001Sample    = "d1b1c98dd7689fb8ec11d242b123dc9b"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// protectQUICInitial encrypts payload and applies the header protection to
+// header, whose packet number takes its last 4 bytes, as the client does.
+func protectQUICInitial(t *testing.T, dcid, header, payload []byte) []byte {
+	key, iv, hp := quicClientInitialKeys(dcid)
+	pnOffset := len(header) - 4
+
+	nonce := append([]byte{}, iv...)
+	pn := binary.BigEndian.Uint32(header[pnOffset:])
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce) - 1 - i] ^= byte(pn >> uint(8 * i))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := append(append([]byte{}, header...), aead.Seal(nil, nonce, payload, header)...)
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, pkt[pnOffset + 4:pnOffset + 4 + aes.BlockSize])
+	pkt[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		pkt[pnOffset + i] ^= mask[1 + i]
+	}
+	return pkt
+}
+
+// rfc9001Initial returns the protected client Initial of RFC 9001, its
+// payload is the CRYPTO frame padded to 1162 bytes.
+func rfc9001Initial(t *testing.T) []byte {
+	payload := make([]byte, 1162)
+	copy(payload, mustDecodeHex(t, rfc9001Crypto))
+	return protectQUICInitial(t, mustDecodeHex(t, rfc9001DCID), mustDecodeHex(t, rfc9001Header), payload)
+}
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	key, iv, hp := quicClientInitialKeys(mustDecodeHex(t, rfc9001DCID))
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"key", key, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", iv, "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hp, "9f50449e04a0e810283a1e9933adedd2"},
+	}
+
+	for _, tt := range tests {
+		if hex.EncodeToString(tt.got) != tt.want {
+			t.Errorf("Client %s %x, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestSniffQUIC(t *testing.T) {
+	pkt := rfc9001Initial(t)
+	if len(pkt) != 1200 {
+		t.Fatalf("Initial of %d bytes, want 1200", len(pkt))
+	}
+	if got := hex.EncodeToString(pkt[:22]); got != rfc9001Protected {
+		t.Fatalf("Protected header %s, want %s", got, rfc9001Protected)
+	}
+	if got := hex.EncodeToString(pkt[22:38]); got != rfc9001Sample {
+		t.Fatalf("Sample %s, want %s", got, rfc9001Sample)
+	}
+
+	corrupted := append([]byte{}, pkt...)
+	corrupted[100] ^= 0xff
+	otherVersion := append([]byte{}, pkt...)
+	otherVersion[4] = 2
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+		host string
+	}{
+		{"RFC 9001 Initial", pkt, nil, "example.com"},
+		{"padded datagram", append(append([]byte{}, pkt...), make([]byte, 100)...), nil, "example.com"},
+		{"truncated", pkt[:600], errSniffMismatch, ""},
+		{"corrupted", corrupted, errSniffMismatch, ""},
+		{"other version", otherVersion, errSniffMismatch, ""},
+		{"short header", []byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05}, errSniffMismatch, ""},
+		{"empty", nil, errSniffMismatch, ""},
+	}
+
+	for _, tt := range tests {
+		var r SniffResult
+		err := sniffQUIC(tt.data, &r)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Protocol != ProtoQUIC || r.Host != tt.host {
+			t.Errorf("%s: sniffed %s %q, want %s %q", tt.name, r.Protocol, r.Host, ProtoQUIC, tt.host)
+		}
+		if len(r.ALPN) != 1 || r.ALPN[0] != "alpn" {
+			t.Errorf("%s: ALPN %v, want [alpn]", tt.name, r.ALPN)
+		}
+	}
+}
+
+func TestQUICCryptoData(t *testing.T) {
+	hello := []byte("0123456789")
+	tests := []struct {
+		name    string
+		payload string
+		want    []byte
+	}{
+		{"one frame", "06000a" + hex.EncodeToString(hello), hello},
+		{"out of order", "060505" + hex.EncodeToString(hello[5:]) + "060005" + hex.EncodeToString(hello[:5]), hello},
+		{"after PING, ACK and PADDING", "01" + "0205000000" + "06000a" + hex.EncodeToString(hello) + "0000", hello},
+		{"gap", "060505" + hex.EncodeToString(hello[5:]), nil},
+		{"frame longer than the payload", "06000b" + hex.EncodeToString(hello), nil},
+	}
+
+	for _, tt := range tests {
+		if got := quicCryptoData(mustDecodeHex(t, tt.payload)); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: CRYPTO data %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// buildClientHello returns a TLS record carrying a ClientHello with the
+// server name sni and the ALPN protocols alpn, the extensions are left out
+// when they are empty.
+func buildClientHello(sni string, alpn []string) []byte {
+	u16 := func(b []byte, v int) []byte {
+		return append(b, byte(v >> 8), byte(v))
+	}
+	var exts []byte
+	if sni != "" {
+		exts = u16(u16(exts, 0x0000), len(sni) + 5)
+		exts = u16(exts, len(sni) + 3)
+		exts = append(u16(append(exts, 0), len(sni)), sni...)
+	}
+	if len(alpn) > 0 {
+		var list []byte
+		for _, p := range alpn {
+			list = append(append(list, byte(len(p))), p...)
+		}
+		exts = u16(u16(exts, 0x0010), len(list) + 2)
+		exts = append(u16(exts, len(list)), list...)
+	}
+
+	// version, random, empty session id, one cipher suite, null compression
+	hello := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	hello = append(hello, 0, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+	hello = append(u16(hello, len(exts)), exts...)
+
+	record := []byte{0x16, 0x03, 0x01}
+	record = u16(record, len(hello) + 4)
+	record = append(record, 0x01, 0, byte(len(hello) >> 8), byte(len(hello)))
+	return append(record, hello...)
+}
+
+func TestSniffTLS(t *testing.T) {
+	rfc9001Hello := mustDecodeHex(t, rfc9001Crypto)[4:]
+	record := []byte{0x16, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(record[3:], uint16(len(rfc9001Hello)))
+	record = append(record, rfc9001Hello...)
+
+	hello := buildClientHello("example.com", []string{"h2", "http/1.1"})
+	notHello := buildClientHello("example.com", nil)
+	notHello[5] = 0x02
+	longHandshake := buildClientHello("example.com", nil)
+	longHandshake[8]++
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+		host string
+		alpn []string
+	}{
+		{"RFC 9001 ClientHello", record, nil, "example.com", []string{"alpn"}},
+		{"server name and ALPN", hello, nil, "example.com", []string{"h2", "http/1.1"}},
+		{"server name in upper case", buildClientHello("WWW.Example.COM", nil), nil, "www.example.com", nil},
+		{"IP address as server name", buildClientHello("192.0.2.1", nil), nil, "", nil},
+		{"no extension", buildClientHello("", nil), nil, "", nil},
+		{"followed by more records", append(append([]byte{}, hello...), 0x17, 0x03, 0x03, 0, 1, 0), nil, "example.com", []string{"h2", "http/1.1"}},
+		{"partial record", hello[:len(hello) - 1], errSniffIncomplete, "", nil},
+		{"partial record header", hello[:3], errSniffIncomplete, "", nil},
+		{"not a ClientHello", notHello, errSniffMismatch, "", nil},
+		{"handshake spanning records", longHandshake, errSniffMismatch, "", nil},
+		{"application data", []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}, errSniffMismatch, "", nil},
+		{"HTTP", []byte("GET / HTTP/1.1\r\n"), errSniffMismatch, "", nil},
+	}
+
+	for _, tt := range tests {
+		var r SniffResult
+		err := sniffTLS(tt.data, &r)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Protocol != ProtoTLS || r.Host != tt.host || fmt.Sprint(r.ALPN) != fmt.Sprint(tt.alpn) {
+			t.Errorf("%s: sniffed %s %q %v, want %s %q %v", tt.name, r.Protocol, r.Host, r.ALPN, ProtoTLS, tt.host, tt.alpn)
+		}
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	hello := buildClientHello("example.com", []string{"h2"})[9:]
+
+	tests := []struct {
+		name string
+		n    int
+		host string
+	}{
+		// the ALPN extension takes the last 9 bytes, the server name one
+		// the 20 before
+		{"whole", len(hello), "example.com"},
+		{"ALPN cut", len(hello) - 3, "example.com"},
+		{"server name cut", len(hello) - 16, ""},
+	}
+
+	for _, tt := range tests {
+		var r SniffResult
+		if err := parseClientHello(hello[:tt.n], true, &r); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if r.Protocol != ProtoTLS || r.Host != tt.host {
+			t.Errorf("%s: sniffed %s %q, want %s %q", tt.name, r.Protocol, r.Host, ProtoTLS, tt.host)
+		}
+	}
+	if err := parseClientHello(hello, false, new(SniffResult)); err != nil {
+		t.Errorf("Whole ClientHello: %s", err)
+	}
+	if err := parseClientHello(hello[:len(hello) - 3], false, new(SniffResult)); err != errSniffMismatch {
+		t.Errorf("Truncated ClientHello: error %v, want %v", err, errSniffMismatch)
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		err    error
+		method string
+		path   string
+		host   string
+	}{
+		{"GET", "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", nil, "GET", "/index.html", "example.com"},
+		{"host with port", "POST /api HTTP/1.1\r\nUser-Agent: test\r\nHost: Example.COM:8080\r\n\r\nbody", nil, "POST", "/api", "example.com"},
+		{"header name in lower case", "HEAD / HTTP/1.0\r\nhost:example.com\r\n\r\n", nil, "HEAD", "/", "example.com"},
+		{"CONNECT", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", nil, "CONNECT", "example.com:443", "example.com"},
+		{"IPv4 host", "GET / HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n", nil, "GET", "/", ""},
+		{"IPv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n", nil, "GET", "/", ""},
+		{"no host", "GET / HTTP/1.0\r\n\r\n", nil, "GET", "/", ""},
+		{"first of pipelined requests", "GET /a HTTP/1.1\r\nHost: a.example\r\n\r\nGET /b HTTP/1.1\r\nHost: b.example\r\n\r\n", nil, "GET", "/a", "a.example"},
+		{"headers not complete", "GET / HTTP/1.1\r\nHost: example.com\r\n", errSniffIncomplete, "", "", ""},
+		{"partial method", "DELE", errSniffIncomplete, "", "", ""},
+		{"unknown method", "FETCH / HTTP/1.1\r\n\r\n", errSniffMismatch, "", "", ""},
+		{"HTTP/2", "GET / HTTP/2\r\n\r\n", errSniffMismatch, "", "", ""},
+		{"bad request line", "GET /\r\nHost: example.com\r\n\r\n", errSniffMismatch, "", "", ""},
+		{"TLS", string(buildClientHello("example.com", nil)), errSniffMismatch, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		var r SniffResult
+		err := sniffHTTP([]byte(tt.data), &r)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Protocol != ProtoHTTP || r.Method != tt.method || r.Path != tt.path || r.Host != tt.host {
+			t.Errorf("%s: sniffed %s %s %s %q, want %s %s %s %q", tt.name, r.Protocol, r.Method, r.Path, r.Host,
+				ProtoHTTP, tt.method, tt.path, tt.host)
+		}
+	}
+}
+
+func TestSniffData(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	// the bits of the id are not mistaken for the flags
+	query.Id = 0xffff
+	dnsQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	dnsReply, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsStream := append([]byte{byte(len(dnsQuery) >> 8), byte(len(dnsQuery))}, dnsQuery...)
+	// a reserved Z bit tells that it is no DNS query before its end
+	notDnsStream := append([]byte{}, dnsStream[:6]...)
+	notDnsStream[5] |= 0x40
+
+	quic := rfc9001Initial(t)
+	quicCorrupted := append([]byte{}, quic...)
+	quicCorrupted[100] ^= 0xff
+
+	stun := append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, make([]byte, 12)...)
+	tracker := append([]byte{0x00, 0x00, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}, make([]byte, 8)...)
+	dht := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+
+	tests := []struct {
+		name     string
+		sniffers []sniffer
+		data     []byte
+		err      error
+		protocol string
+		host     string
+	}{
+		{"TCP TLS", tcpSniffers, buildClientHello("example.com", nil), nil, ProtoTLS, "example.com"},
+		{"TCP HTTP", tcpSniffers, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), nil, ProtoHTTP, "example.com"},
+		{"TCP SSH", tcpSniffers, []byte("SSH-2.0-OpenSSH_8.9\r\n"), nil, ProtoSSH, ""},
+		{"TCP BitTorrent", tcpSniffers, append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...), nil, ProtoBitTorrent, ""},
+		{"TCP DNS", tcpSniffers, dnsStream, nil, ProtoDNS, ""},
+		{"TCP partial DNS", tcpSniffers, dnsStream[:8], errSniffIncomplete, "", ""},
+		{"TCP not DNS", tcpSniffers, notDnsStream, errSniffMismatch, "", ""},
+		{"TCP partial SSH", tcpSniffers, []byte("SS"), errSniffIncomplete, "", ""},
+		{"TCP unknown", tcpSniffers, []byte("\x00\x01\x00\x00\x00\x00\x00\x00binary"), errSniffMismatch, "", ""},
+		{"TCP server SSH", tcpServerSniffers, []byte("SSH-2.0-dropbear\r\n"), nil, ProtoSSH, ""},
+		{"TCP server HTTP", tcpServerSniffers, []byte("HTTP/1.1 200 OK\r\n"), nil, ProtoHTTP, ""},
+		{"TCP server SMTP", tcpServerSniffers, []byte("220 mail.example.com ESMTP\r\n"), errSniffMismatch, "", ""},
+		{"UDP QUIC", udpSniffers, quic, nil, ProtoQUIC, "example.com"},
+		{"UDP QUIC without ClientHello", udpSniffers, quicCorrupted, nil, ProtoQUIC, ""},
+		{"UDP DNS", udpSniffers, dnsQuery, nil, ProtoDNS, ""},
+		{"UDP DNS reply", udpSniffers, dnsReply, errSniffMismatch, "", ""},
+		{"UDP STUN", udpSniffers, stun, nil, ProtoSTUN, ""},
+		{"UDP STUN with bad length", udpSniffers, append(append([]byte{}, stun...), 0, 0, 0, 0), errSniffMismatch, "", ""},
+		{"UDP BitTorrent tracker", udpSniffers, tracker, nil, ProtoBitTorrent, ""},
+		{"UDP BitTorrent DHT", udpSniffers, dht, nil, ProtoBitTorrent, ""},
+		{"UDP unknown", udpSniffers, []byte("hello"), errSniffMismatch, "", ""},
+		{"UDP server DNS", udpServerSniffers, dnsReply, nil, ProtoDNS, ""},
+		{"UDP server QUIC", udpServerSniffers, quic, nil, ProtoQUIC, ""},
+		{"UDP server STUN", udpServerSniffers, stun, nil, ProtoSTUN, ""},
+	}
+
+	for _, tt := range tests {
+		var r SniffResult
+		err := sniffData(tt.data, tt.sniffers, &r)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if r.Protocol != tt.protocol || r.Host != tt.host {
+			t.Errorf("%s: sniffed %s %q, want %s %q", tt.name, r.Protocol, r.Host, tt.protocol, tt.host)
+		}
+	}
+}
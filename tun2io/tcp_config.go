@@ -0,0 +1,224 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/transport/tcp"
+)
+
+const (
+	defaultListenBacklog = 10
+
+	// The largest receive buffer announced without window scaling
+	maxUnscaledWindow = 65535
+
+	tcpFlagSYN = 0x02
+	tcpOptionEnd = 0
+	tcpOptionNop = 1
+	tcpOptionMSS = 2
+)
+
+var (
+	errInvalidTCPConfig = errors.New("Invalid TCP config.")
+)
+
+// TCPConfig tunes the TCP endpoints of the stack, the zero value keeps the
+// netstack defaults.
+type TCPConfig struct {
+	// SendBufferSize and ReceiveBufferSize are the buffer sizes of the
+	// endpoints in bytes, the window announced to the clients follows the
+	// receive buffer, so a high-BDP link needs one of about its BDP
+	SendBufferSize     int
+	ReceiveBufferSize  int
+
+	// SACK enables or disables the selective acknowledgments, nil keeps the
+	// setting of the stack
+	SACK               *bool
+
+	// DisableWindowScale sets the receive buffer to 64KB when it is 0,
+	// netstack chooses the window scale from the receive buffer and has no
+	// switch for it, so a larger ReceiveBufferSize is invalid with it
+	DisableWindowScale bool
+
+	// CongestionControl is the name of the algorithm, like "reno" or "cubic"
+	CongestionControl  string
+
+	// MSS clamps the MSS option of the SYN segments in both directions, it
+	// needs a CaptureEndpoint as link endpoint
+	MSS                int
+
+	// KeepaliveIdle enables the keepalives, sent after KeepaliveIdle without
+	// data, every KeepaliveInterval, KeepaliveCount times before the
+	// connection is dropped
+	KeepaliveIdle      time.Duration
+	KeepaliveInterval  time.Duration
+	KeepaliveCount     int
+
+	// ListenBacklog is the number of pending connections of each listener
+	ListenBacklog      int
+}
+
+// validate checks c and returns it with its defaults.
+func (c TCPConfig) validate() (TCPConfig, error) {
+	if c.SendBufferSize < 0 || c.ReceiveBufferSize < 0 || c.MSS < 0 || c.MSS > 0xffff ||
+		c.KeepaliveIdle < 0 || c.KeepaliveInterval < 0 || c.KeepaliveCount < 0 || c.ListenBacklog < 0 {
+		return c, errInvalidTCPConfig
+	}
+	if c.DisableWindowScale && c.ReceiveBufferSize > maxUnscaledWindow {
+		return c, errInvalidTCPConfig
+	}
+
+	if c.DisableWindowScale && c.ReceiveBufferSize == 0 {
+		c.ReceiveBufferSize = maxUnscaledWindow
+	}
+	if c.ListenBacklog == 0 {
+		c.ListenBacklog = defaultListenBacklog
+	}
+	return c, nil
+}
+
+// applyStack sets the options of c shared by all the endpoints of s, like
+// the buffer sizes of the accepted endpoints which fix their window scale
+// during the handshake.
+func (c TCPConfig) applyStack(s tcpip.Stack) error {
+	if c.SendBufferSize != 0 {
+		opt := tcp.SendBufferSizeOption{Min:1, Default:c.SendBufferSize, Max:c.SendBufferSize}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return err
+		}
+	}
+	if c.ReceiveBufferSize != 0 {
+		opt := tcp.ReceiveBufferSizeOption{Min:1, Default:c.ReceiveBufferSize, Max:c.ReceiveBufferSize}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return err
+		}
+	}
+	if c.SACK != nil {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.SACKEnabled(*c.SACK)); err != nil {
+			return err
+		}
+	}
+	if c.CongestionControl != "" {
+		opt := tcpip.CongestionControlOption(c.CongestionControl)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEndpoint sets the options of c on ep, the ones it doesn't support are
+// logged.
+func (c TCPConfig) applyEndpoint(ep tcpip.Endpoint) {
+	var opts []interface{}
+	if c.SendBufferSize != 0 {
+		opts = append(opts, tcpip.SendBufferSizeOption(c.SendBufferSize))
+	}
+	if c.ReceiveBufferSize != 0 {
+		opts = append(opts, tcpip.ReceiveBufferSizeOption(c.ReceiveBufferSize))
+	}
+	if c.CongestionControl != "" {
+		opts = append(opts, tcpip.CongestionControlOption(c.CongestionControl))
+	}
+	if c.KeepaliveIdle != 0 {
+		opts = append(opts, tcpip.KeepaliveEnabledOption(1), tcpip.KeepaliveIdleOption(c.KeepaliveIdle))
+		if c.KeepaliveInterval != 0 {
+			opts = append(opts, tcpip.KeepaliveIntervalOption(c.KeepaliveInterval))
+		}
+		if c.KeepaliveCount != 0 {
+			opts = append(opts, tcpip.KeepaliveCountOption(c.KeepaliveCount))
+		}
+	}
+
+	for _, opt := range opts {
+		if err := ep.SetSockOpt(opt); err != nil {
+			log.Printf("Set TCP option %T failed: %s\n", opt, err)
+		}
+	}
+}
+
+// clampMSS lowers the MSS option of pkt to mss if pkt is a TCP SYN segment,
+// the checksum is updated incrementally so pkt may end before the payload.
+func clampMSS(pkt []byte, mss uint16) {
+	if mss == 0 || len(pkt) == 0 {
+		return
+	}
+
+	var off int
+	switch pkt[0] >> 4 {
+	case 4:
+		off = int(pkt[0] & 0x0f) * 4
+		if len(pkt) < ipv4HeaderSize || pkt[9] != ipProtoTCP || binary.BigEndian.Uint16(pkt[6:]) & 0x1fff != 0 {
+			return
+		}
+	case 6:
+		// SYN segments are sent without extension headers
+		off = ipv6HeaderSize
+		if len(pkt) < ipv6HeaderSize || pkt[6] != ipProtoTCP {
+			return
+		}
+	default:
+		return
+	}
+
+	if len(pkt) < off + 20 || pkt[off + 13] & tcpFlagSYN == 0 {
+		return
+	}
+	end := off + int(pkt[off + 12] >> 4) * 4
+	if end > len(pkt) {
+		return
+	}
+
+	for i := off + 20; i < end; {
+		switch pkt[i] {
+		case tcpOptionEnd:
+			return
+		case tcpOptionNop:
+			i++
+			continue
+		}
+		if i + 1 >= end || pkt[i + 1] < 2 {
+			return
+		}
+
+		if pkt[i] == tcpOptionMSS && pkt[i + 1] == 4 && i + 4 <= end {
+			old := binary.BigEndian.Uint16(pkt[i + 2:])
+			if old > mss {
+				binary.BigEndian.PutUint16(pkt[i + 2:], mss)
+				sum := binary.BigEndian.Uint16(pkt[off + 16:])
+				binary.BigEndian.PutUint16(pkt[off + 16:], updateChecksum(sum, old, mss))
+			}
+			return
+		}
+		i += int(pkt[i + 1])
+	}
+}
+
+// updateChecksum returns the internet checksum sum after a 16-bit word of
+// the data changed from old to new, as in RFC 1624.
+func updateChecksum(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = s & 0xffff + s >> 16
+	s = s & 0xffff + s >> 16
+	return ^uint16(s)
+}
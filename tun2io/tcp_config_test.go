@@ -0,0 +1,46 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"testing"
+)
+
+func TestTCPConfigWindowScale(t *testing.T) {
+	tests := []struct {
+		receive    int
+		want       int
+		err        error
+	}{
+		{0, maxUnscaledWindow, nil},
+		{32768, 32768, nil},
+		{maxUnscaledWindow, maxUnscaledWindow, nil},
+		{maxUnscaledWindow + 1, 0, errInvalidTCPConfig},
+	}
+
+	for _, tt := range tests {
+		c, err := TCPConfig{ReceiveBufferSize:tt.receive, DisableWindowScale:true}.validate()
+		if err != tt.err {
+			t.Errorf("Receive buffer %d: error %v, want %v", tt.receive, err, tt.err)
+			continue
+		}
+		if err == nil && c.ReceiveBufferSize != tt.want {
+			t.Errorf("Receive buffer %d: got %d, want %d", tt.receive, c.ReceiveBufferSize, tt.want)
+		}
+	}
+}
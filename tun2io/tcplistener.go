@@ -36,12 +36,28 @@ type TcpListener struct {
 	wq            *waiter.Queue
 	waitEndry     waiter.Entry
 
+	timeout       time.Duration
+
 	ctx           context.Context
 	ctxCancel     context.CancelFunc
 	closeOne      sync.Once
 }
 
 func NewTcpListener(s tcpip.Stack, nid tcpip.NICID, netProto tcpip.NetworkProtocolNumber, listenerId TransportID) (m *TcpListener, err error) {
+	return NewTcpListenerWithConfig(s, nid, netProto, listenerId, nil)
+}
+
+// NewTcpListenerWithConfig is like NewTcpListener with the listen timeout and
+// the backlog of config, the defaults if it is nil.
+func NewTcpListenerWithConfig(s tcpip.Stack, nid tcpip.NICID, netProto tcpip.NetworkProtocolNumber, listenerId TransportID, config *Config) (m *TcpListener, err error) {
+	if config == nil {
+		defaults := Config{}.withDefaults()
+		config = &defaults
+	}
+	backlog := config.TCP.ListenBacklog
+	if backlog == 0 {
+		backlog = defaultListenBacklog
+	}
 
 	protocol := header.TCPProtocolNumber
 	var wq waiter.Queue
@@ -54,7 +70,7 @@ func NewTcpListener(s tcpip.Stack, nid tcpip.NICID, netProto tcpip.NetworkProtoc
 		return nil, err
 	}
 
-	if err = ep.Listen(10); err != nil {
+	if err = ep.Listen(backlog); err != nil {
 		return nil, err
 	}
 
@@ -68,6 +84,7 @@ func NewTcpListener(s tcpip.Stack, nid tcpip.NICID, netProto tcpip.NetworkProtoc
 		notifyCh:notifyCh,
 		wq:&wq,
 		waitEndry:waitEntry,
+		timeout:config.ListenTimeout,
 	}
 	m.ctx, m.ctxCancel = context.WithCancel(context.Background())
 
@@ -85,7 +102,7 @@ func (t *TcpListener) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
 					continue AcceptLoop
 				case <-t.ctx.Done():
 					return nil, nil, t.ctx.Err()
-				case <- time.After(listenTimeout):
+				case <- time.After(t.timeout):
 					return nil, nil, ErrTimeout
 				}
 			} else {
@@ -95,7 +112,7 @@ func (t *TcpListener) Accept() (tcpip.Endpoint, *waiter.Queue, error) {
 
 		l, _ := n.GetLocalAddress()
 		r, _ := n.GetRemoteAddress()
-		log.Printf("Accept a connection from %s:%d->%s:%d\n", r.Addr, r.Port, l.Addr, l.Port)
+		log.Printf("Accept a connection from %s->%s\n", hostPort(r.Addr, r.Port), hostPort(l.Addr, l.Port))
 		return n, wq, nil
 	}
 
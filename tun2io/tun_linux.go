@@ -0,0 +1,281 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+	"github.com/FTwOoO/netstack/tcpip"
+	"github.com/FTwOoO/netstack/tcpip/link/tun"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	errNoTunName = errors.New("No tun name.")
+	errNoTunAddr = errors.New("No tun address.")
+	errMultiQueueTAP = errors.New("Multi-queue TAP is not supported.")
+)
+
+const (
+	defaultTunMTU = 1500
+	iffMultiQueue = 0x100
+)
+
+type TunConfig struct {
+	// Name of the tun, it is created if it doesn't exist and then removed
+	// with the last fd closed unless it was made persistent
+	Name   string
+
+	// MTU of the tun, 0 keeps the current one, or 1500 for a new tun
+	MTU    int
+
+	// Queues opened on the tun, more than 1 opens it with IFF_MULTI_QUEUE,
+	// which can't be done on an existing single queue tun
+	Queues int
+
+	// TAP opens a TAP device exchanging Ethernet frames instead, with the
+	// address MAC given to the stack, or a generated one if it is nil
+	TAP    bool
+	MAC    net.HardwareAddr
+
+	// Addrs are the addresses given to the tun and the stack, with the masks
+	// of their subnets, as in 192.168.4.1/24
+	Addrs  []*net.IPNet
+
+	// Routes are routed through the tun in the main table, with a priority
+	// of Metric if it is not 0. An existing route to one of them with the
+	// same priority makes OpenTun fail instead of being replaced.
+	Routes []*net.IPNet
+	Metric int
+}
+
+// TunDevice is a tun opened and configured by OpenTun.
+type TunDevice struct {
+	Name      string
+	Index     int
+	Fd        int
+	MTU       int
+
+	// Fds are the fds of the queues, starting with Fd
+	Fds       []int
+
+	config    TunConfig
+	oldMTU    int
+	closeOnce sync.Once
+
+	// routes are the routes added by setup, the ones removed by Close
+	routes    []*kernelRoute
+}
+
+// OpenTun opens the tun of config and sets its MTU, addresses and routes
+// through netlink before putting it up. What it sets is undone by Close.
+func OpenTun(config TunConfig) (*TunDevice, error) {
+	if config.Name == "" {
+		return nil, errNoTunName
+	}
+
+	if config.TAP && config.Queues > 1 {
+		return nil, errMultiQueueTAP
+	}
+
+	fds, err := openTunQueues(config.Name, config.Queues, config.TAP)
+	if err != nil {
+		return nil, err
+	}
+
+	iface, err := net.InterfaceByName(config.Name)
+	if err != nil {
+		closeFds(fds)
+		return nil, err
+	}
+
+	d := &TunDevice{Name:config.Name, Index:iface.Index, Fd:fds[0], Fds:fds, MTU:iface.MTU, config:config, oldMTU:iface.MTU}
+	if config.MTU > 0 {
+		d.MTU = config.MTU
+	} else if d.MTU <= 0 {
+		d.MTU = defaultTunMTU
+	}
+
+	if err := d.setup(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// openTunQueues opens n queues of the tun name, or one without multi-queue
+// if n is less than 2.
+func openTunQueues(name string, n int, tap bool) ([]int, error) {
+	if n < 2 && !tap {
+		fd, err := tun.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return []int{fd}, nil
+	}
+
+	flags := uint16(syscall.IFF_TUN | syscall.IFF_NO_PI)
+	if tap {
+		flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	}
+	if n < 2 {
+		n = 1
+	} else {
+		flags |= iffMultiQueue
+	}
+
+	fds := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		fd, err := openTunQueue(name, flags)
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// openTunQueue opens the tun or TAP name with the flags of TUNSETIFF.
+func openTunQueue(name string, flags uint16) (int, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR | syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = flags
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return -1, errno
+	}
+	return fd, nil
+}
+
+func closeFds(fds []int) error {
+	var err error
+	for _, fd := range fds {
+		if e := syscall.Close(fd); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (d *TunDevice) setup() error {
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.setLink(d.Index, d.MTU, false); err != nil {
+		return err
+	}
+
+	for _, a := range d.config.Addrs {
+		if err := c.addr(syscall.RTM_NEWADDR, d.Index, a); err != nil {
+			return err
+		}
+	}
+
+	if err := c.setLink(d.Index, 0, true); err != nil {
+		return err
+	}
+
+	for _, dst := range d.config.Routes {
+		r := d.route(dst)
+		if err := c.route(syscall.RTM_NEWROUTE, r); err != nil {
+			return err
+		}
+		d.routes = append(d.routes, r)
+	}
+	return nil
+}
+
+func (d *TunDevice) route(dst *net.IPNet) *kernelRoute {
+	return &kernelRoute{Dst:dst, Oif:d.Index, Metric:d.config.Metric}
+}
+
+// Close removes the routes and the addresses of the tun, puts it down with
+// its previous MTU and closes its fds.
+func (d *TunDevice) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		if c, e := newNetlinkConn(); e == nil {
+			for _, r := range d.routes {
+				c.route(syscall.RTM_DELROUTE, r)
+			}
+			for _, a := range d.config.Addrs {
+				c.addr(syscall.RTM_DELADDR, d.Index, a)
+			}
+			c.setLink(d.Index, d.oldMTU, false)
+			c.Close()
+		}
+		err = closeFds(d.Fds)
+	})
+	return err
+}
+
+// Tun2IOWithTun opens the tun of config and starts a manager on it like
+// Tun2IOAddrs with the addresses of config. The tun is to be closed by the
+// caller on shutdown.
+func Tun2IOWithTun(config TunConfig, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, *TunDevice, error) {
+	if len(config.Addrs) == 0 {
+		return nil, nil, errNoTunAddr
+	}
+
+	d, err := OpenTun(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Tun %s opened with MTU %d and %d queues\n", d.Name, d.MTU, len(d.Fds))
+
+	var linkId tcpip.LinkEndpointID
+	if config.TAP {
+		linkId, err = CreateTapLinkEndpoint(d.Fd, d.MTU, config.MAC)
+	} else if len(d.Fds) > 1 {
+		linkId, err = CreateMultiQueueLinkEndpoint(d.Fds, d.MTU)
+	} else {
+		linkId, err = CreateFdLinkEndpoint(d.Fd, d.MTU)
+	}
+	if err != nil {
+		d.Close()
+		return nil, nil, err
+	}
+
+	m, err := Tun2IOAddrs(config.Addrs, linkId, createDNSEndpoint, dialer)
+	if err != nil {
+		d.Close()
+		return nil, nil, err
+	}
+	return m, d, nil
+}
@@ -0,0 +1,202 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// enterNetns moves the test to a new network namespace, or skips it without
+// the capabilities to create one and a tun in it. The thread is left locked,
+// so it ends with the test instead of going back to the pool.
+func enterNetns(t *testing.T) {
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("No network namespace, CAP_SYS_ADMIN and CAP_NET_ADMIN are needed: %s", err)
+	}
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("No tun device: %s", err)
+	}
+	syscall.Close(fd)
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.IP = ip
+	return n
+}
+
+// linkRoutes returns the prefixes of the main table routes through the link
+// index.
+func linkRoutes(t *testing.T, index int) map[string]bool {
+	c, err := newNetlinkConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	routes := make(map[string]bool, 0)
+	for _, family := range []byte{syscall.AF_INET, syscall.AF_INET6} {
+		body := make([]byte, syscall.SizeofRtMsg)
+		body[0] = family
+		msgs, err := c.dump(syscall.RTM_GETROUTE, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range msgs {
+			m := &msgs[i]
+			if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg || m.Data[4] != rtTableMain {
+				continue
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(m)
+			if err != nil {
+				continue
+			}
+
+			var dst net.IP
+			var oif int
+			for _, a := range attrs {
+				switch a.Attr.Type {
+				case syscall.RTA_DST:
+					dst = net.IP(a.Value)
+				case syscall.RTA_OIF:
+					oif = int(nativeEndian.Uint32(a.Value))
+				}
+			}
+			if dst != nil && oif == index {
+				routes[(&net.IPNet{IP:dst, Mask:net.CIDRMask(int(m.Data[1]), 8 * len(dst))}).String()] = true
+			}
+		}
+	}
+	return routes
+}
+
+func TestOpenTun(t *testing.T) {
+	enterNetns(t)
+
+	const name = "tun2iotest"
+	config := TunConfig{
+		Name:name,
+		MTU:1400,
+		Addrs:[]*net.IPNet{mustParseCIDR(t, "10.9.0.1/24"), mustParseCIDR(t, "fd09::1/64")},
+		Routes:[]*net.IPNet{mustParseCIDR(t, "10.30.0.0/16"), mustParseCIDR(t, "fd30::/48")},
+	}
+
+	d, err := OpenTun(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface.MTU != 1400 {
+		t.Errorf("MTU %d, want 1400", iface.MTU)
+	}
+	if iface.Flags & net.FlagUp == 0 {
+		t.Errorf("Tun isn't up")
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool, 0)
+	for _, a := range addrs {
+		found[a.String()] = true
+	}
+	for _, a := range config.Addrs {
+		if !found[a.String()] {
+			t.Errorf("Address %s not set, the tun has %v", a, addrs)
+		}
+	}
+
+	routes := linkRoutes(t, d.Index)
+	for _, r := range []string{"10.30.0.0/16", "fd30::/48"} {
+		if !routes[r] {
+			t.Errorf("Route %s not set, the tun has %v", r, routes)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a tun which isn't persistent goes away with its last fd, or is left
+	// down without the addresses
+	if iface, err := net.InterfaceByName(name); err == nil {
+		if iface.Flags & net.FlagUp != 0 {
+			t.Errorf("Tun still up after Close")
+		}
+		if addrs, _ := iface.Addrs(); len(addrs) != 0 {
+			t.Errorf("Addresses %v left after Close", addrs)
+		}
+	}
+	if routes := linkRoutes(t, d.Index); len(routes) != 0 {
+		t.Errorf("Routes %v left after Close", routes)
+	}
+}
+
+func TestOpenTunKeepsExistingRoutes(t *testing.T) {
+	enterNetns(t)
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setLink(lo.Index, 0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := mustParseCIDR(t, "10.20.0.0/16")
+	if err := c.route(syscall.RTM_NEWROUTE, &kernelRoute{Dst:existing, Oif:lo.Index}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TunConfig{
+		Name:"tun2iotest",
+		Addrs:[]*net.IPNet{mustParseCIDR(t, "10.9.0.1/24")},
+		Routes:[]*net.IPNet{mustParseCIDR(t, "10.30.0.0/16"), existing},
+	}
+	if d, err := OpenTun(config); err == nil {
+		d.Close()
+		t.Fatalf("OpenTun replaced the route to %s", existing)
+	}
+
+	if routes := linkRoutes(t, lo.Index); !routes[existing.String()] {
+		t.Errorf("Route %s through lo lost, lo has %v", existing, routes)
+	}
+}
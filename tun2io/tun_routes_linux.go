@@ -0,0 +1,341 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const (
+	defaultRouteTable = 2048
+	defaultRulePriority = 2048
+)
+
+type TunRouteConfig struct {
+	// Include are routed through the tun. Without FwMark they go in the main
+	// table, where 0.0.0.0/0 and ::/0 are split in two halves so that the
+	// default routes are kept.
+	Include   []*net.IPNet
+
+	// Exclude keep their route outside of the tun, through the default route
+	// of the main table, they must be more specific than the includes. Only
+	// the families of the includes with a default route are excluded, and an
+	// existing route to an exclude is kept as it is.
+	Exclude   []*net.IPNet
+
+	// Router gives the dialers whose upstream servers are excluded, the ones
+	// given by name are resolved once by Install
+	Router    *Router
+
+	// FwMark enables policy routing: the routes go in Table, looked up by the
+	// packets without the mark FwMark, which is to be set on the sockets of
+	// the dialers like DirectDialer.Mark does
+	FwMark    int
+	Table     int
+	Priority  int
+
+	// Metric is the priority of the routes added to the main table
+	Metric    int
+
+	// StatePath is the file recording the routes and rules installed, so that
+	// they can be removed after a crash by the next Install or RestoreTunRoutes
+	StatePath string
+}
+
+// tunRouteState is the content of the state file.
+type tunRouteState struct {
+	Routes []*kernelRoute
+	Rules  []*kernelRule
+}
+
+// TunRoutes installs the routes of a TunRouteConfig through a tun.
+type TunRoutes struct {
+	mu     sync.Mutex
+	dev    *TunDevice
+	config TunRouteConfig
+	state  tunRouteState
+}
+
+func NewTunRoutes(dev *TunDevice, config TunRouteConfig) *TunRoutes {
+	if config.FwMark != 0 {
+		if config.Table == 0 {
+			config.Table = defaultRouteTable
+		}
+		if config.Priority == 0 {
+			config.Priority = defaultRulePriority
+		}
+	}
+	return &TunRoutes{dev:dev, config:config}
+}
+
+// splitDefault returns the halves of the default route of the family of n,
+// or n.
+func splitDefault(n *net.IPNet) []*net.IPNet {
+	if ones, _ := n.Mask.Size(); ones != 0 {
+		return []*net.IPNet{n}
+	}
+
+	bits := 8 * len(n.Mask)
+	low := &net.IPNet{IP:make(net.IP, len(n.Mask)), Mask:net.CIDRMask(1, bits)}
+	high := &net.IPNet{IP:make(net.IP, len(n.Mask)), Mask:net.CIDRMask(1, bits)}
+	high.IP[0] = 0x80
+	return []*net.IPNet{low, high}
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP:ip4, Mask:net.CIDRMask(8 * net.IPv4len, 8 * net.IPv4len)}
+	}
+	return &net.IPNet{IP:ip, Mask:net.CIDRMask(8 * net.IPv6len, 8 * net.IPv6len)}
+}
+
+// upstreamNets resolves the upstream servers of the dialers of the router.
+func (t *TunRoutes) upstreamNets() ([]*net.IPNet, error) {
+	if t.config.Router == nil {
+		return nil, nil
+	}
+
+	var nets []*net.IPNet
+	for _, addr := range t.config.Router.UpstreamAddrs() {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			nets = append(nets, hostNet(ip))
+		}
+	}
+	return nets, nil
+}
+
+// plan returns the routes and the rules of the config.
+func (t *TunRoutes) plan(c *netlinkConn) (*tunRouteState, error) {
+	upstreams, err := t.upstreamNets()
+	if err != nil {
+		return nil, err
+	}
+	excludes := append(append([]*net.IPNet{}, t.config.Exclude...), upstreams...)
+
+	state := &tunRouteState{}
+	families := make(map[byte]bool, 0)
+	for _, n := range t.config.Include {
+		_, family := ipFamily(n.IP)
+		families[family] = true
+
+		if t.config.FwMark != 0 {
+			state.Routes = append(state.Routes, &kernelRoute{Dst:n, Oif:t.dev.Index, Table:t.config.Table})
+			continue
+		}
+		for _, half := range splitDefault(n) {
+			state.Routes = append(state.Routes, &kernelRoute{Dst:half, Oif:t.dev.Index, Metric:t.config.Metric})
+		}
+	}
+
+	gateways := make(map[byte]*kernelRoute, 0)
+	for _, n := range excludes {
+		// the families not routed through the tun need no exclusion
+		_, family := ipFamily(n.IP)
+		if !families[family] {
+			continue
+		}
+
+		if t.config.FwMark != 0 {
+			state.Routes = append(state.Routes, &kernelRoute{Dst:n, Table:t.config.Table, Type:syscall.RTN_THROW})
+			continue
+		}
+
+		gw, ok := gateways[family]
+		if !ok {
+			gw, err = c.defaultRoute(family, t.dev.Index)
+			if err == errNoDefaultRoute {
+				log.Printf("No default route to keep the excludes of family %d on\n", family)
+			} else if err != nil {
+				return nil, err
+			}
+			gateways[family] = gw
+		}
+		if gw == nil {
+			continue
+		}
+		state.Routes = append(state.Routes, &kernelRoute{Dst:n, Gateway:gw.Gateway, Oif:gw.Oif, Metric:t.config.Metric, Onlink:gw.Onlink})
+	}
+
+	if t.config.FwMark != 0 {
+		for family := range families {
+			state.Rules = append(state.Rules, &kernelRule{
+				Family:family,
+				Mark:t.config.FwMark,
+				Table:t.config.Table,
+				Priority:t.config.Priority,
+			})
+		}
+	}
+	return state, nil
+}
+
+func writeTunRouteState(path string, state *tunRouteState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Install adds the routes and the rules of the config, after removing the
+// ones left in the state file.
+func (t *TunRoutes) Install() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.config.StatePath != "" {
+		if err := RestoreTunRoutes(t.config.StatePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	state, err := t.plan(c)
+	if err != nil {
+		return err
+	}
+
+	// Each entry is recorded before it is added, as the process can die at
+	// any point, and only the ones added are removed
+	t.state = tunRouteState{}
+	for _, r := range state.Routes {
+		t.state.Routes = append(t.state.Routes, r)
+		err := t.record()
+		if err == nil {
+			if err = c.route(syscall.RTM_NEWROUTE, r); err != nil {
+				t.state.Routes = t.state.Routes[:len(t.state.Routes) - 1]
+			}
+			if err == syscall.EEXIST && r.Oif != t.dev.Index {
+				// the destination already has a route outside of the tun
+				log.Printf("Keep the existing route to %v\n", r.Dst)
+				err = t.record()
+			}
+		}
+		if err != nil {
+			t.abort(c)
+			return err
+		}
+	}
+	for _, r := range state.Rules {
+		t.state.Rules = append(t.state.Rules, r)
+		err := t.record()
+		if err == nil {
+			if err = c.rule(syscall.RTM_NEWRULE, r); err != nil {
+				t.state.Rules = t.state.Rules[:len(t.state.Rules) - 1]
+			}
+		}
+		if err != nil {
+			t.abort(c)
+			return err
+		}
+	}
+	return nil
+}
+
+// record writes the routes and the rules added to the state file, if any.
+func (t *TunRoutes) record() error {
+	if t.config.StatePath == "" {
+		return nil
+	}
+	return writeTunRouteState(t.config.StatePath, &t.state)
+}
+
+// abort removes what a failed Install added and the state file.
+func (t *TunRoutes) abort(c *netlinkConn) {
+	removeTunRouteState(c, &t.state)
+	if t.config.StatePath != "" {
+		os.Remove(t.config.StatePath)
+	}
+}
+
+// removeTunRouteState removes what is left of state, missing entries are
+// ignored.
+func removeTunRouteState(c *netlinkConn, state *tunRouteState) {
+	for _, r := range state.Rules {
+		c.rule(syscall.RTM_DELRULE, r)
+	}
+	for _, r := range state.Routes {
+		if err := c.route(syscall.RTM_DELROUTE, r); err != nil && err != syscall.ESRCH {
+			log.Printf("Remove route %v failed: %v\n", r.Dst, err)
+		}
+	}
+	*state = tunRouteState{}
+}
+
+// Close removes the routes and the rules installed, and the state file.
+func (t *TunRoutes) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	removeTunRouteState(c, &t.state)
+	if t.config.StatePath != "" {
+		os.Remove(t.config.StatePath)
+	}
+	return nil
+}
+
+// RestoreTunRoutes removes the routes and the rules recorded in the state
+// file path, as left by a process that didn't close its TunRoutes.
+func RestoreTunRoutes(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	state := &tunRouteState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	removeTunRouteState(c, state)
+	return os.Remove(path)
+}
@@ -0,0 +1,144 @@
+// +build linux
+
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+
+package tun2io
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+func routeStrings(routes []*kernelRoute) []string {
+	s := make([]string, 0, len(routes))
+	for _, r := range routes {
+		s = append(s, fmt.Sprintf("%s gw %s oif %d table %d metric %d type %d onlink %v",
+			r.Dst, r.Gateway, r.Oif, r.Table, r.Metric, r.Type, r.Onlink))
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestTunRoutesPlan(t *testing.T) {
+	enterNetns(t)
+
+	// lo carries the IPv4 default route, there is none for IPv6
+	c, err := newNetlinkConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setLink(lo.Index, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	gw := net.IPv4(192, 168, 1, 1)
+	if err := c.route(syscall.RTM_NEWROUTE, &kernelRoute{Dst:mustParseCIDR(t, "0.0.0.0/0"), Gateway:gw, Oif:lo.Index, Onlink:true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tun is not created, plan only needs its index
+	const tunIndex = 1000
+	tun := func(dst string, metric int) string {
+		return fmt.Sprintf("%s gw <nil> oif %d table 0 metric %d type 0 onlink false", dst, tunIndex, metric)
+	}
+	viaLo := func(dst string, metric int) string {
+		return fmt.Sprintf("%s gw %s oif %d table 0 metric %d type 0 onlink true", dst, gw, lo.Index, metric)
+	}
+
+	tests := []struct {
+		name   string
+		config TunRouteConfig
+		routes []string
+		rules  []string
+	}{
+		{
+			"split default",
+			TunRouteConfig{Include:[]*net.IPNet{mustParseCIDR(t, "0.0.0.0/0")}, Metric:10},
+			[]string{tun("0.0.0.0/1", 10), tun("128.0.0.0/1", 10)},
+			nil,
+		},
+		{
+			"more specific include is kept",
+			TunRouteConfig{Include:[]*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+			[]string{tun("10.0.0.0/8", 0)},
+			nil,
+		},
+		{
+			"excludes through the default route",
+			TunRouteConfig{
+				Include:[]*net.IPNet{mustParseCIDR(t, "0.0.0.0/0")},
+				Exclude:[]*net.IPNet{mustParseCIDR(t, "1.2.3.4/32"), mustParseCIDR(t, "172.16.0.0/12"), mustParseCIDR(t, "2001:db8::/32")},
+				Metric:10,
+			},
+			[]string{tun("0.0.0.0/1", 10), tun("128.0.0.0/1", 10), viaLo("1.2.3.4/32", 10), viaLo("172.16.0.0/12", 10)},
+			nil,
+		},
+		{
+			"no default route to exclude through",
+			TunRouteConfig{
+				Include:[]*net.IPNet{mustParseCIDR(t, "::/0")},
+				Exclude:[]*net.IPNet{mustParseCIDR(t, "2001:db8::/32")},
+			},
+			[]string{tun("::/1", 0), tun("8000::/1", 0)},
+			nil,
+		},
+		{
+			"policy routing",
+			TunRouteConfig{
+				Include:[]*net.IPNet{mustParseCIDR(t, "0.0.0.0/0")},
+				Exclude:[]*net.IPNet{mustParseCIDR(t, "1.2.3.4/32"), mustParseCIDR(t, "2001:db8::/32")},
+				FwMark:0x10,
+			},
+			[]string{
+				fmt.Sprintf("0.0.0.0/0 gw <nil> oif %d table %d metric 0 type 0 onlink false", tunIndex, defaultRouteTable),
+				fmt.Sprintf("1.2.3.4/32 gw <nil> oif 0 table %d metric 0 type %d onlink false", defaultRouteTable, syscall.RTN_THROW),
+			},
+			[]string{fmt.Sprintf("family %d mark 16 table %d priority %d", syscall.AF_INET, defaultRouteTable, defaultRulePriority)},
+		},
+	}
+
+	for _, tt := range tests {
+		r := NewTunRoutes(&TunDevice{Index:tunIndex}, tt.config)
+		state, err := r.plan(c)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+
+		sort.Strings(tt.routes)
+		if got := routeStrings(state.Routes); fmt.Sprint(got) != fmt.Sprint(tt.routes) {
+			t.Errorf("%s: routes\n%v\nwant\n%v", tt.name, got, tt.routes)
+		}
+
+		var rules []string
+		for _, rule := range state.Rules {
+			rules = append(rules, fmt.Sprintf("family %d mark %d table %d priority %d", rule.Family, rule.Mark, rule.Table, rule.Priority))
+		}
+		if fmt.Sprint(rules) != fmt.Sprint(tt.rules) {
+			t.Errorf("%s: rules %v, want %v", tt.name, rules, tt.rules)
+		}
+	}
+}
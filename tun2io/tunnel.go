@@ -19,7 +19,9 @@ package tun2io
 import (
 	"net"
 	"context"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/FTwOoO/netstack/tcpip"
 	"github.com/FTwOoO/netstack/waiter"
@@ -30,7 +32,39 @@ import (
 )
 
 type Tunnel struct {
+	// bytesSent and bytesReceived count the payload from the client to the
+	// target and back, they are first to be 64-bit aligned for atomic
+	bytesSent         uint64
+	bytesReceived     uint64
+
 	Id                TransportID
+
+	// Started and Ended are the times the tunnel was created and closed
+	Started           time.Time
+	Ended             time.Time
+
+	// CloseReason is the error the tunnel was closed with
+	CloseReason       error
+
+	// Domain is the name the target address was resolved from, if known
+	Domain            string
+
+	// Route is the name of the route chosen for the tunnel
+	Route             string
+
+	// Sniffed is what was learned from the first bytes sent by the client
+	Sniffed           SniffResult
+
+	// DialName is dialed instead of the target address if it is set
+	DialName          string
+
+	// protocol is the application protocol of the flow, from the first bytes
+	// of the client or, failing that, of the server
+	protocol          string
+
+	// sniffedPackets are read from ep before Run and sent first
+	sniffedPackets    [][]byte
+
 	wq                *waiter.Queue
 	ep                tcpip.Endpoint
 
@@ -45,11 +79,33 @@ type Tunnel struct {
 	ctx               context.Context
 	ctxCancel         context.CancelFunc
 	closeCallback     func(TransportID)
+	config            *Config
 
 	closeOne          sync.Once
 }
 
 func NewTunnel(network string, wq *waiter.Queue, ep tcpip.Endpoint, dialer proxy.Dialer, closeCallback func(TransportID)) (*Tunnel, error) {
+	return NewTunnelWithConfig(network, wq, ep, dialer, closeCallback, nil)
+}
+
+// NewTunnelWithConfig is like NewTunnel with the timeouts and the buffer
+// sizes of config, the defaults if it is nil.
+func NewTunnelWithConfig(network string, wq *waiter.Queue, ep tcpip.Endpoint, dialer proxy.Dialer, closeCallback func(TransportID), config *Config) (*Tunnel, error) {
+	t := NewPendingTunnel(network, wq, ep, closeCallback, config)
+	if err := t.Connect(dialer); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewPendingTunnel is like NewTunnelWithConfig without dialing, so that the
+// tunnel can be sniffed and routed first. Connect dials its target.
+func NewPendingTunnel(network string, wq *waiter.Queue, ep tcpip.Endpoint, closeCallback func(TransportID), config *Config) *Tunnel {
+	if config == nil {
+		defaults := Config{}.withDefaults()
+		config = &defaults
+	}
+
 	srcAddr, _ := ep.GetRemoteAddress()
 	remoteAddr, _ := ep.GetLocalAddress()
 
@@ -63,31 +119,112 @@ func NewTunnel(network string, wq *waiter.Queue, ep tcpip.Endpoint, dialer proxy
 
 	t := &Tunnel{
 		Id:id,
+		Started:time.Now(),
 		wq:wq,
 		ep:ep,
-		tunnelRecvPackets:make(chan []byte, 256),
-		recvPackets:make(chan []byte, 256),
+		tunnelRecvPackets:make(chan []byte, config.QueueSize),
+		recvPackets:make(chan []byte, config.QueueSize),
 		closeCallback: closeCallback,
+		config:config,
 	}
+	// Created here so that the tunnel can be closed before it runs
+	t.ctx, t.ctxCancel = context.WithCancel(context.Background())
+
+	t.SetStatus(StatusNew)
+	return t
+}
 
+// Connect dials the target of the tunnel with dialer.
+func (t *Tunnel) Connect(dialer proxy.Dialer) error {
 	t.SetStatus(StatusConnecting)
 
 	var err error
-	targetAddr := fmt.Sprintf("%s:%d", id.RemoteAddress, id.RemotePort)
-	log.Printf("Try to connect to %s by proto %s\n", targetAddr, network)
+	network := t.Id.Network()
+	targetAddr := hostPort(t.Id.RemoteAddress, t.Id.RemotePort)
+	if t.DialName != "" {
+		targetAddr = net.JoinHostPort(t.DialName, strconv.Itoa(int(t.Id.RemotePort)))
+	}
+	log.Printf("Try to connect to %s by proto %s\n", t.ToString(), network)
 	if t.connOut, err = dialer.Dial(network, targetAddr); err != nil {
 		t.SetStatus(StatusConnectionFailed)
-		return nil, err
+		return err
 	}
 
 	t.SetStatus(StatusConnected)
+	return nil
+}
 
-	return t, nil
+// ToString describes the tunnel like TransportID.ToString, with the target
+// named by its domain and the protocol appended if they are known.
+func (t *Tunnel) ToString() string {
+	s := t.Id.ToString()
+	if t.Domain != "" {
+		s = fmt.Sprintf("[%s]%s -> %s(%s)", t.Id.Network(), hostPort(t.Id.SrcAddress, t.Id.SrcPort), net.JoinHostPort(t.Domain, strconv.Itoa(int(t.Id.RemotePort))), net.IP(t.Id.RemoteAddress))
+	}
+
+	if p := t.Protocol(); p != ProtoUnknown {
+		s += " " + p
+	}
+	return s
 }
 
-func (t *Tunnel) Run() {
+// Protocol returns the application protocol of the tunnel, or ProtoUnknown.
+func (t *Tunnel) Protocol() string {
+	t.statusMu.Lock()
+	p := t.protocol
+	t.statusMu.Unlock()
 
-	t.ctx, t.ctxCancel = context.WithCancel(context.Background())
+	if p == "" {
+		return ProtoUnknown
+	}
+	return p
+}
+
+func (t *Tunnel) setProtocol(p string) {
+	t.statusMu.Lock()
+	t.protocol = p
+	t.statusMu.Unlock()
+}
+
+// Sniff reads the first bytes sent by the client and passes them to
+// sniffers until one of them succeeds, all of them fail or timeout expires.
+// Stream data is accumulated, for datagrams only the first one is looked at.
+// The bytes read are sent to the target first when the tunnel runs.
+func (t *Tunnel) Sniff(timeout time.Duration, sniffers []sniffer) error {
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+
+	t.wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer t.wq.EventUnregister(&waitEntry)
+
+	var data []byte
+	deadline := time.After(timeout)
+
+	Sniffing:for len(data) < t.config.ReadBufferSize {
+		v, err := t.ep.Read(nil)
+		if err != nil && err == tcpip.ErrWouldBlock {
+			select {
+			case <-notifyCh:
+				continue Sniffing
+			case <-deadline:
+				return ErrTimeout
+			}
+		} else if err != nil {
+			return err
+		}
+
+		t.sniffedPackets = append(t.sniffedPackets, v)
+		data = append(data, v...)
+
+		err = sniffData(data, sniffers, &t.Sniffed)
+		if err != errSniffIncomplete || t.Id.Transport == header.UDPProtocolNumber {
+			return err
+		}
+	}
+
+	return errBufferIsFull
+}
+
+func (t *Tunnel) Run() {
 	go t.reader()
 	go t.writer()
 	go t.tunnelReader()
@@ -95,6 +232,16 @@ func (t *Tunnel) Run() {
 	t.SetStatus(StatusProxying)
 }
 
+// BytesSent returns the number of bytes sent from the client to the target.
+func (t *Tunnel) BytesSent() uint64 {
+	return atomic.LoadUint64(&t.bytesSent)
+}
+
+// BytesReceived returns the number of bytes sent from the target to the client.
+func (t *Tunnel) BytesReceived() uint64 {
+	return atomic.LoadUint64(&t.bytesReceived)
+}
+
 func (t *Tunnel) SetStatus(s TunnelStatus) {
 	t.statusMu.Lock()
 	t.status = s
@@ -123,7 +270,7 @@ func (t *Tunnel) reader() {
 				break Reading
 			case <-notifyCh:
 				continue Reading
-			case <-time.After(readTimeout):
+			case <-time.After(t.config.ReadTimeout):
 				t.Close(ErrTimeout)
 				break Reading
 			}
@@ -160,7 +307,7 @@ func (t *Tunnel) writer() {
 						break Writing
 					case <-notifyCh:
 						continue Write1Packet
-					case <-time.After(writeTimeout):
+					case <-time.After(t.config.WriteTimeout):
 						t.Close(ErrTimeout)
 						break Writing
 					}
@@ -169,6 +316,7 @@ func (t *Tunnel) writer() {
 					break Writing
 
 				} else {
+					atomic.AddUint64(&t.bytesReceived, uint64(len(chunk)))
 					break Write1Packet
 				}
 			}
@@ -179,6 +327,13 @@ func (t *Tunnel) writer() {
 }
 
 func (t *Tunnel) tunnelReader() {
+	// a TCP client that did not speak first may be classified by the banner
+	// of the server, a UDP flow by the first datagram of the server
+	classify := t.Protocol() == ProtoUnknown
+	serverSniffers := tcpServerSniffers
+	if t.Id.Transport == header.UDPProtocolNumber {
+		serverSniffers = udpServerSniffers
+	}
 
 	Reading:for {
 		select {
@@ -187,15 +342,22 @@ func (t *Tunnel) tunnelReader() {
 			break Reading
 
 		default:
-			data := make([]byte, readBufSize)
-			t.connOut.SetReadDeadline(time.Now().Add(readTimeout))
+			data := make([]byte, t.config.ReadBufferSize)
+			t.connOut.SetReadDeadline(time.Now().Add(t.config.ReadTimeout))
 			n, err := t.connOut.Read(data)
 			if err != nil {
 				t.Close(err)
 				break Reading
 			}
 			if n > 0 {
-				log.Printf("receive a packet from tunnel[%s]\n", t.Id.ToString())
+				if classify {
+					classify = false
+					var r SniffResult
+					if sniffData(data[:n], serverSniffers, &r) == nil {
+						t.setProtocol(r.Protocol)
+					}
+				}
+				log.Printf("receive a packet from tunnel[%s]\n", t.ToString())
 				t.tunnelRecvPackets <- data[0:n]
 			}
 		}
@@ -205,26 +367,37 @@ func (t *Tunnel) tunnelReader() {
 }
 
 func (t *Tunnel) tunnelWriter() {
+	// The bytes read by Sniff go first, they can be more chunks than
+	// recvPackets holds
+	sniffed := t.sniffedPackets
+	t.sniffedPackets = nil
 
 	Writing:for {
-		select {
-		case <-t.ctx.Done():
-			log.Printf("tunnel writer done because of '%s'", t.ctx.Err())
-			break Writing
-		case chunk := <-t.recvPackets:
-			Write1Packet:for {
-				t.connOut.SetWriteDeadline(time.Now().Add(writeTimeout))
-				n, err := t.connOut.Write(chunk)
-				if err != nil {
-					t.Close(err)
-					break Writing
-				} else if n < len(chunk) {
-					chunk = chunk[n:]
-					continue Write1Packet
-				} else {
-					log.Printf("Write a packet to tunnel[%s]\n", t.Id.ToString())
-					break Write1Packet
-				}
+		var chunk []byte
+		if len(sniffed) > 0 {
+			chunk, sniffed = sniffed[0], sniffed[1:]
+		} else {
+			select {
+			case <-t.ctx.Done():
+				log.Printf("tunnel writer done because of '%s'", t.ctx.Err())
+				break Writing
+			case chunk = <-t.recvPackets:
+			}
+		}
+
+		Write1Packet:for {
+			t.connOut.SetWriteDeadline(time.Now().Add(t.config.WriteTimeout))
+			n, err := t.connOut.Write(chunk)
+			atomic.AddUint64(&t.bytesSent, uint64(n))
+			if err != nil {
+				t.Close(err)
+				break Writing
+			} else if n < len(chunk) {
+				chunk = chunk[n:]
+				continue Write1Packet
+			} else {
+				log.Printf("Write a packet to tunnel[%s]\n", t.ToString())
+				break Write1Packet
 			}
 		}
 	}
@@ -242,6 +415,8 @@ func (t *Tunnel) Close(reason error) {
 		}
 
 		log.Printf("%s\n", reason.Error())
+		t.CloseReason = reason
+		t.Ended = time.Now()
 		t.SetStatus(StatusClosing)
 		t.ctxCancel()
 		t.connOut.Close()
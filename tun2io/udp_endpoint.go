@@ -41,12 +41,25 @@ type UdpEndpoint struct {
 	RecvPackets  chan UdpPacket
 	WritePackets chan UdpPacket
 
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
 	ctx          context.Context
 	ctxCancel    context.CancelFunc
 	closeOne     sync.Once
 }
 
 func CreateUdpEndpoint(s tcpip.Stack, netProto tcpip.NetworkProtocolNumber, addr tcpip.FullAddress) (*UdpEndpoint, error) {
+	return CreateUdpEndpointWithConfig(s, netProto, addr, nil)
+}
+
+// CreateUdpEndpointWithConfig is like CreateUdpEndpoint with the read and the
+// write timeouts of config, the defaults if it is nil.
+func CreateUdpEndpointWithConfig(s tcpip.Stack, netProto tcpip.NetworkProtocolNumber, addr tcpip.FullAddress, config *Config) (*UdpEndpoint, error) {
+	if config == nil {
+		defaults := Config{}.withDefaults()
+		config = &defaults
+	}
 
 	var wq waiter.Queue
 	ep, err := s.NewEndpoint(udp.ProtocolNumber, netProto, &wq)
@@ -64,6 +77,8 @@ func CreateUdpEndpoint(s tcpip.Stack, netProto tcpip.NetworkProtocolNumber, addr
 		wq:&wq,
 		RecvPackets:make(chan UdpPacket, 100),
 		WritePackets:make(chan UdpPacket, 100),
+		readTimeout:config.ReadTimeout,
+		writeTimeout:config.WriteTimeout,
 	}
 	u.ctx, u.ctxCancel = context.WithCancel(context.Background())
 
@@ -89,7 +104,7 @@ func (t *UdpEndpoint) reader() {
 				break Reading
 			case <-notifyCh:
 				continue Reading
-			case <-time.After(readTimeout):
+			case <-time.After(t.readTimeout):
 				t.Close(ErrTimeout)
 				break Reading
 			}
@@ -126,7 +141,7 @@ func (t *UdpEndpoint) writer() {
 						break Writing
 					case <-notifyCh:
 						continue Write1Packet
-					case <-time.After(writeTimeout):
+					case <-time.After(t.writeTimeout):
 						t.Close(ErrTimeout)
 						break Writing
 					}
@@ -19,9 +19,10 @@ package tun2io
 
 import (
 	"strings"
-	"log"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"github.com/FTwOoO/netstack/tcpip"
 	"github.com/FTwOoO/netstack/tcpip/link/fdbased"
 	"github.com/FTwOoO/netstack/tcpip/network/ipv4"
@@ -34,91 +35,199 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// rotateFiles shifts path.N to path.N+1 and path to path.1, keeping maxFiles
+// files including the one about to be created at path.
+func rotateFiles(path string, maxFiles int) {
+	if maxFiles <= 1 {
+		return
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", path, maxFiles - 1))
+	for i := maxFiles - 2; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i + 1))
+	}
+	os.Rename(path, path + ".1")
+}
+
+// CreateFdLinkEndpoint creates the link endpoint of the tun fd, wrapped in a
+// CaptureEndpoint so that captures can be started by the manager.
 func CreateFdLinkEndpoint(fd int, mtu int) (tcpip.LinkEndpointID, error) {
-	linkID := fdbased.New(fd, mtu, nil)
+	linkID, _ := NewCaptureEndpoint(fdbased.New(fd, mtu, nil))
 	return linkID, nil
 }
 
+// CreateTapLinkEndpoint creates the link endpoint of the TAP fd, exchanging
+// Ethernet frames with the address mac, wrapped like CreateFdLinkEndpoint.
+// A nil mac generates one.
+func CreateTapLinkEndpoint(fd int, mtu int, mac net.HardwareAddr) (tcpip.LinkEndpointID, error) {
+	linkID, _ := NewCaptureEndpoint(NewEthernetEndpoint(&fdPacketIO{fd:fd}, uint32(mtu), mac, nil))
+	return linkID, nil
+}
 
-func createStack(mainAddr net.IP, mainNet *net.IPNet, nicid tcpip.NICID, linkEndpointId tcpip.LinkEndpointID) (tcpip.Stack, error) {
-	var addr tcpip.Address
-	var proto tcpip.NetworkProtocolNumber
+// CreateMultiQueueLinkEndpoint creates the link endpoint of the queue fds of
+// a multi-queue tun, wrapped like CreateFdLinkEndpoint.
+func CreateMultiQueueLinkEndpoint(fds []int, mtu int) (tcpip.LinkEndpointID, error) {
+	linkID, _ := NewCaptureEndpoint(NewMultiQueueEndpoint(fds, uint32(mtu)))
+	return linkID, nil
+}
+
+// CreateReadWriterLinkEndpoint creates a link endpoint exchanging raw IP
+// packets with rw instead of a tun fd, wrapped like CreateFdLinkEndpoint.
+func CreateReadWriterLinkEndpoint(rw io.ReadWriter, mtu int) (tcpip.LinkEndpointID, error) {
+	linkID, _ := NewCaptureEndpoint(NewReadWriterEndpoint(rw, uint32(mtu), nil))
+	return linkID, nil
+}
+
+// CreatePacketLinkEndpoint creates a link endpoint exchanging raw IP packets
+// with p, wrapped like CreateFdLinkEndpoint.
+func CreatePacketLinkEndpoint(p PacketIO, mtu int) (tcpip.LinkEndpointID, error) {
+	linkID, _ := NewCaptureEndpoint(NewPacketEndpoint(p, uint32(mtu), nil))
+	return linkID, nil
+}
 
-	if mainAddr.To4() != nil {
-		addr = tcpip.Address(mainAddr.To4())
-		proto = ipv4.ProtocolNumber
-	} else if mainAddr.To16() != nil {
-		addr = tcpip.Address(mainAddr.To16())
+// ipNetToSubnet returns the address, the subnet and the network protocol of
+// a, whose IP is the address and whose mask is the one of the subnet.
+func ipNetToSubnet(a *net.IPNet) (tcpip.Address, tcpip.Subnet, tcpip.NetworkProtocolNumber, error) {
+	ip, mask := a.IP.To4(), a.Mask
+	proto := ipv4.ProtocolNumber
+	if ip == nil {
+		ip = a.IP.To16()
 		proto = ipv6.ProtocolNumber
-	} else {
-		err := fmt.Errorf("Unknown IP type: %v", mainAddr)
-		log.Fatal(err)
-		return nil, err
+	} else if len(mask) == net.IPv6len {
+		mask = mask[12:]
 	}
 
+	if ip == nil || len(mask) != len(ip) {
+		err := fmt.Errorf("Unknown IP type: %v", a)
+		return "", tcpip.Subnet{}, 0, err
+	}
 
+	subnet, err := tcpip.NewSubnet(tcpip.Address(ip.Mask(mask)), tcpip.AddressMask(mask))
+	if err != nil {
+		return "", tcpip.Subnet{}, 0, err
+	}
+	return tcpip.Address(ip), subnet, proto, nil
+}
+
+func createStack(addrs []*net.IPNet, nicid tcpip.NICID, linkEndpointId tcpip.LinkEndpointID) (tcpip.Stack, error) {
 	// Create the stack with ip and tcp protocols, then add a tun-based
 	// NIC and address.
 	s := stack.New([]string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
 	if err := s.CreateNIC(nicid, linkEndpointId); err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
-	if err := s.AddAddress(nicid, proto, addr); err != nil {
-		log.Fatal(err)
-		return nil, err
+	// Add a default route for each IP version in use.
+	var routes []tcpip.Route
+	families := make(map[int]bool, 0)
+	for i, a := range addrs {
+		addr, _, _, err := addStackAddress(s, nicid, a)
+		if err != nil {
+			removeStackAddresses(s, nicid, addrs[:i])
+			return nil, err
+		}
+
+		if !families[len(addr)] {
+			families[len(addr)] = true
+			routes = append(routes, tcpip.Route{
+				Destination: tcpip.Address(strings.Repeat("\x00", len(addr))),
+				Mask:        tcpip.Address(strings.Repeat("\x00", len(addr))),
+				Gateway:     "",
+				NIC:         nicid,
+			})
+		}
 	}
 
-	nIp := mainNet.IP.To4()
-	mask := tcpip.AddressMask(mainNet.Mask)
-	subnet, err := tcpip.NewSubnet(tcpip.Address(nIp), mask)
+	s.SetRouteTable(routes)
+	return s, nil
+}
+
+func Tun2IO(ip net.IP, subnet *net.IPNet, linkId tcpip.LinkEndpointID, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, error) {
+	return Tun2IOAddrs([]*net.IPNet{{IP:ip, Mask:subnet.Mask}}, linkId, createDNSEndpoint, dialer)
+}
+
+// Tun2IOAddrs is like Tun2IO for a NIC with several addresses, like an IPv4
+// and an IPv6 one for dual stack. Each address is given with the mask of its
+// subnet, as in 192.168.4.1/24 or fd00::1/64, and has its own DNS endpoint.
+func Tun2IOAddrs(addrs []*net.IPNet, linkId tcpip.LinkEndpointID, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, error) {
+	return NewTun2IO(linkId, Config{Addrs:addrs, DNS:createDNSEndpoint, Dialer:dialer})
+}
+
+// NewTun2IO creates a stack with a NIC on the link endpoint linkId and starts
+// a manager on it, both configured by config.
+func NewTun2IO(linkId tcpip.LinkEndpointID, config Config) (*Tun2ioManager, error) {
+	config, err := config.validate()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := s.(*stack.Stack).AddSubnet(nicid, proto, subnet); err != nil {
+	s, err := createStack(config.Addrs, config.NICID, linkId)
+	if err != nil {
 		return nil, err
 	}
 
-	// Add default route.
-	s.SetRouteTable([]tcpip.Route{
-		{
-			Destination: tcpip.Address(strings.Repeat("\x00", len(addr))),
-			Mask:        tcpip.Address(strings.Repeat("\x00", len(addr))),
-			Gateway:     "",
-			NIC:         nicid,
-		},
-	})
-
-	return s, nil
-}
-
-func Tun2IO(ip net.IP, subnet *net.IPNet, linkId tcpip.LinkEndpointID, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, error) {
-
-	s, err := createStack(ip, subnet, defaultNicId, linkId)
+	manager, err := newTun2ioManager(s, config)
 	if err != nil {
-		log.Fatal(err)
+		removeStackAddresses(s, config.NICID, config.Addrs)
+		return nil, err
+	}
+	manager.linkEP = stack.FindLinkEndpoint(linkId)
+	manager.nics[0].linkEP = manager.linkEP
+	if ep, ok := manager.linkEP.(*CaptureEndpoint); ok {
+		manager.captureEP = ep
 	}
+	manager.hookLink(manager.nics[0])
 
-	if createDNSEndpoint {
-		ep, err := CreateUdpEndpoint(s, ipv4.ProtocolNumber, tcpip.FullAddress{NIC:defaultNicId, Addr:tcpip.Address(ip.To4()), Port:defaultDNSPort})
-		if err != nil {
-			log.Fatal(err)
+	if err := manager.SetTCPConfig(config.TCP); err != nil {
+		manager.abort()
+		return nil, err
+	}
+
+	if config.DNS {
+		handler := config.DNSHandler
+		if handler == nil {
+			handler, _ = dnsrelay.NewDNSServer(nil, true)
+		}
+		manager.dnsCache = NewDnsCache(handler)
+		manager.dnsHosts = NewDnsHosts(manager.dnsCache)
+		manager.dnsFilter = NewDnsFilter(manager.dnsHosts)
+		manager.dnsHandler = &DnsRecorder{Next:manager.dnsFilter, Table:manager.domains}
+
+		dnsAddrs := config.DNSAddrs
+		if len(dnsAddrs) == 0 {
+			for _, a := range config.Addrs {
+				dnsAddrs = append(dnsAddrs, a.IP)
+			}
 		}
 
-		handlerServ, _ := dnsrelay.NewDNSServer(nil, true)
-		_, err = CreateDnsServer(ep, handlerServ)
-		if err != nil {
-			log.Fatal(err)
+		manager.nicsMu.Lock()
+		for _, ip := range dnsAddrs {
+			addr, _, proto, err := ipNetToSubnet(&net.IPNet{IP:ip, Mask:net.CIDRMask(8 * len(ip), 8 * len(ip))})
+			if err == nil {
+				err = manager.createDnsServer(config.NICID, addr, proto)
+			}
+			if err != nil {
+				manager.nicsMu.Unlock()
+				manager.abort()
+				return nil, err
+			}
 		}
+		manager.nicsMu.Unlock()
 	}
 
-	manager, err := NewTun2ioManager(s, defaultNicId, dialer)
-
 	return manager, nil
 }
 
+// Tun2IOWithPacketIO starts a manager like Tun2IOAddrs on the packets of p
+// instead of a device.
+func Tun2IOWithPacketIO(addrs []*net.IPNet, p PacketIO, mtu int, createDNSEndpoint bool, dialer proxy.Dialer) (*Tun2ioManager, error) {
+	linkId, err := CreatePacketLinkEndpoint(p, mtu)
+	if err != nil {
+		return nil, err
+	}
+	return Tun2IOAddrs(addrs, linkId, createDNSEndpoint, dialer)
+}
+
 func TcpEcho(wq *waiter.Queue, ep tcpip.Endpoint) {
 	defer ep.Close()
 
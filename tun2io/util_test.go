@@ -0,0 +1,326 @@
+/*
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ * Author: FTwOoO <booobooob@gmail.com>
+ */
+
+package tun2io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testTCPFlagFIN = 0x01
+	testTCPFlagACK = 0x10
+	testTCPFlagPSH = 0x08
+)
+
+// redirectDialer connects every flow to addr, a local echo server.
+type redirectDialer struct {
+	addr string
+}
+
+func (d *redirectDialer) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, d.addr)
+}
+
+// startTCPEcho starts a TCP server echoing what it reads and returns its
+// address.
+func startTCPEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// startUDPEcho starts a UDP server sending back each datagram it reads.
+func startUDPEcho(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c
+}
+
+// testPacket is a TCP or UDP packet written by the stack.
+type testPacket struct {
+	src, dst   net.IP
+	proto      byte
+	sport      uint16
+	dport      uint16
+	seq, ack   uint32
+	flags      byte
+	payload    []byte
+}
+
+// parseTestPacket decodes an IPv4 or IPv6 packet without extension headers.
+func parseTestPacket(pkt []byte) (*testPacket, bool) {
+	p := &testPacket{}
+	var transport []byte
+	switch {
+	case len(pkt) >= ipv4HeaderSize && pkt[0] >> 4 == 4:
+		hl := int(pkt[0] & 0x0f) * 4
+		l := int(binary.BigEndian.Uint16(pkt[2:]))
+		if l < hl || l > len(pkt) {
+			return nil, false
+		}
+		p.src, p.dst, p.proto = net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[9]
+		transport = pkt[hl:l]
+	case len(pkt) >= ipv6HeaderSize && pkt[0] >> 4 == 6:
+		l := ipv6HeaderSize + int(binary.BigEndian.Uint16(pkt[4:]))
+		if l > len(pkt) {
+			return nil, false
+		}
+		p.src, p.dst, p.proto = net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[6]
+		transport = pkt[ipv6HeaderSize:l]
+	default:
+		return nil, false
+	}
+
+	switch p.proto {
+	case ipProtoTCP:
+		if len(transport) < 20 || int(transport[12] >> 4) * 4 > len(transport) {
+			return nil, false
+		}
+		p.seq = binary.BigEndian.Uint32(transport[4:])
+		p.ack = binary.BigEndian.Uint32(transport[8:])
+		p.flags = transport[13]
+		p.payload = transport[int(transport[12] >> 4) * 4:]
+	case ipProtoUDP:
+		if len(transport) < 8 {
+			return nil, false
+		}
+		p.payload = transport[8:]
+	default:
+		return nil, false
+	}
+	p.sport = binary.BigEndian.Uint16(transport[0:])
+	p.dport = binary.BigEndian.Uint16(transport[2:])
+	return p, true
+}
+
+// buildTestPacket returns an IP packet from src to dst carrying transport,
+// whose checksum is filled in.
+func buildTestPacket(src, dst net.IP, proto byte, transport []byte) []byte {
+	sum := uint32(0)
+	addWords := func(b []byte) {
+		for i := 0; i + 1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b) % 2 == 1 {
+			sum += uint32(b[len(b) - 1]) << 8
+		}
+	}
+	checksum := func() uint16 {
+		for sum > 0xffff {
+			sum = sum & 0xffff + sum >> 16
+		}
+		return ^uint16(sum)
+	}
+
+	csumOff := 16
+	if proto == ipProtoUDP {
+		csumOff = 6
+	}
+	if src4 := src.To4(); src4 != nil {
+		src, dst = src4, dst.To4()
+	}
+	addWords(src)
+	addWords(dst)
+	sum += uint32(len(transport)) + uint32(proto)
+	addWords(transport)
+	binary.BigEndian.PutUint16(transport[csumOff:], checksum())
+
+	var hdr []byte
+	if len(src) == net.IPv4len {
+		hdr = make([]byte, ipv4HeaderSize)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:], uint16(ipv4HeaderSize + len(transport)))
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000)
+		hdr[8], hdr[9] = 64, proto
+		copy(hdr[12:], src)
+		copy(hdr[16:], dst)
+		sum = 0
+		addWords(hdr)
+		binary.BigEndian.PutUint16(hdr[10:], checksum())
+	} else {
+		hdr = make([]byte, ipv6HeaderSize)
+		hdr[0] = 0x60
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(transport)))
+		hdr[6], hdr[7] = proto, 64
+		copy(hdr[8:], src)
+		copy(hdr[24:], dst)
+	}
+	return append(hdr, transport...)
+}
+
+func buildTestTCP(src, dst net.IP, sport, dport uint16, seq, ack uint32, flags byte, payload []byte) []byte {
+	seg := make([]byte, 20 + len(payload))
+	binary.BigEndian.PutUint16(seg[0:], sport)
+	binary.BigEndian.PutUint16(seg[2:], dport)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12], seg[13] = 5 << 4, flags
+	binary.BigEndian.PutUint16(seg[14:], 65535)
+	copy(seg[20:], payload)
+	return buildTestPacket(src, dst, ipProtoTCP, seg)
+}
+
+func buildTestUDP(src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+	dgram := make([]byte, 8 + len(payload))
+	binary.BigEndian.PutUint16(dgram[0:], sport)
+	binary.BigEndian.PutUint16(dgram[2:], dport)
+	binary.BigEndian.PutUint16(dgram[4:], uint16(len(dgram)))
+	copy(dgram[8:], payload)
+	return buildTestPacket(src, dst, ipProtoUDP, dgram)
+}
+
+// testClient plays a client behind the link endpoint of a stack, sending
+// packets with send and receiving the ones the stack writes from recv.
+type testClient struct {
+	t    *testing.T
+	send func(pkt []byte)
+	recv <-chan []byte
+}
+
+// expect returns the first packet written by the stack for which match is
+// true, the others are discarded.
+func (c *testClient) expect(what string, match func(p *testPacket) bool) *testPacket {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pkt := <-c.recv:
+			if p, ok := parseTestPacket(pkt); ok && match(p) {
+				return p
+			}
+		case <-timeout:
+			c.t.Fatalf("No %s received", what)
+			return nil
+		}
+	}
+}
+
+// tcpEcho opens a connection from client to server through the stack and
+// checks the data sent is echoed back.
+func (c *testClient) tcpEcho(client, server net.IP) {
+	const cport, sport = 40000, 80
+	data := []byte("ping over tcp")
+	from := func(p *testPacket) bool {
+		return p.proto == ipProtoTCP && p.src.Equal(server) && p.dst.Equal(client) && p.sport == sport && p.dport == cport
+	}
+
+	c.send(buildTestTCP(client, server, cport, sport, 1000, 0, tcpFlagSYN, nil))
+	synAck := c.expect("SYN-ACK", func(p *testPacket) bool {
+		return from(p) && p.flags & (tcpFlagSYN | testTCPFlagACK) == tcpFlagSYN | testTCPFlagACK
+	})
+	if synAck.ack != 1001 {
+		c.t.Fatalf("SYN-ACK acknowledges %d, want 1001", synAck.ack)
+	}
+
+	c.send(buildTestTCP(client, server, cport, sport, 1001, synAck.seq + 1, testTCPFlagACK, nil))
+	c.send(buildTestTCP(client, server, cport, sport, 1001, synAck.seq + 1, testTCPFlagPSH | testTCPFlagACK, data))
+
+	var echoed []byte
+	for len(echoed) < len(data) {
+		p := c.expect("echoed data", func(p *testPacket) bool {
+			return from(p) && len(p.payload) > 0
+		})
+		echoed = append(echoed, p.payload...)
+	}
+	if !bytes.Equal(echoed, data) {
+		c.t.Fatalf("Echoed %q, want %q", echoed, data)
+	}
+
+	last := synAck.seq + 1 + uint32(len(echoed))
+	c.send(buildTestTCP(client, server, cport, sport, 1001 + uint32(len(data)), last, testTCPFlagFIN | testTCPFlagACK, nil))
+}
+
+// udpEcho sends a datagram from client to server through the stack and
+// checks it is echoed back.
+func (c *testClient) udpEcho(client, server net.IP) {
+	const cport, sport = 40001, 7
+	data := []byte("ping over udp")
+
+	c.send(buildTestUDP(client, server, cport, sport, data))
+	p := c.expect("UDP reply", func(p *testPacket) bool {
+		return p.proto == ipProtoUDP && p.src.Equal(server) && p.dst.Equal(client) && p.sport == sport && p.dport == cport
+	})
+	if !bytes.Equal(p.payload, data) {
+		c.t.Fatalf("Echoed %q, want %q", p.payload, data)
+	}
+}
+
+// newDualStackClient starts a dual stack manager on a MemoryEndpoint whose
+// flows are all dialed to echo.
+func newDualStackClient(t *testing.T, echo string) (*testClient, *Tun2ioManager) {
+	linkID, ep := NewMemoryEndpoint(replayMTU, replayQueueSize)
+	addrs := []*net.IPNet{
+		{IP:net.ParseIP("192.168.4.1"), Mask:net.CIDRMask(24, 32)},
+		{IP:net.ParseIP("fd00::1"), Mask:net.CIDRMask(64, 128)},
+	}
+	m, err := Tun2IOAddrs(addrs, linkID, false, &redirectDialer{addr:echo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t:t, send:ep.Inject, recv:ep.C}, m
+}
+
+func TestIPv6TCPFlow(t *testing.T) {
+	l := startTCPEcho(t)
+	defer l.Close()
+
+	c, m := newDualStackClient(t, l.Addr().String())
+	defer m.Close()
+
+	c.tcpEcho(net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1"))
+}
+
+func TestIPv6UDPFlow(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	c, m := newDualStackClient(t, echo.LocalAddr().String())
+	defer m.Close()
+
+	c.udpEcho(net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1"))
+}